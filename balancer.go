@@ -0,0 +1,74 @@
+package cslb
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// Balancer is a handle to an independent cslb instance created with New(). Each Balancer has its
+// own SRV and health caches, status server and statistics and is completely isolated from the
+// package-level instance used by Enable() and the http.DefaultTransport.
+type Balancer struct {
+	cslb *cslb
+}
+
+// New creates and starts a Balancer configured with the supplied Options. Any zero-valued Options
+// are replaced with the package defaults. The cache cleaners and optional status server run until
+// Stop() is called, thus:
+//
+//	lb := cslb.New(cslb.Options{FoundSRVTTL: time.Minute, StatusServerAddress: "127.0.0.1:8081"})
+//	defer lb.Stop()
+//	client := &http.Client{Transport: lb.Enable(&http.Transport{})}
+func New(opts Options) *Balancer {
+	return &Balancer{cslb: newCslbWithOptions(opts).start()}
+}
+
+// Enable activates processing by this Balancer for the http.Transport. It is the Balancer
+// equivalent of the package-level Enable() function.
+func (t *Balancer) Enable(ht *http.Transport) *http.Transport {
+	return t.cslb.enable(ht)
+}
+
+// Disable restores the http.Transport to its state prior to Enable. It is the Balancer equivalent
+// of the package-level Disable() function.
+func (t *Balancer) Disable(ht *http.Transport) *http.Transport {
+	return Disable(ht)
+}
+
+// NewRoundTripper enables the http.Transport for this Balancer and returns a RoundTripper which
+// wraps it. It is the Balancer equivalent of the package-level NewRoundTripper() function.
+func (t *Balancer) NewRoundTripper(ht *http.Transport) *RoundTripper {
+	return &RoundTripper{Transport: t.Enable(ht)}
+}
+
+// NewDialer creates a Dialer which uses this Balancer. It is the Balancer equivalent of the
+// package-level NewDialer() function.
+func (t *Balancer) NewDialer(next func(ctx context.Context, network, addr string) (net.Conn, error)) *Dialer {
+	return &Dialer{cslb: t.cslb, next: next}
+}
+
+// RegisterHealthChecker registers the HealthChecker with this Balancer. It is the Balancer
+// equivalent of the package-level RegisterHealthChecker() function.
+func (t *Balancer) RegisterHealthChecker(name string, hc HealthChecker) error {
+	return t.cslb.registerHealthChecker(name, hc)
+}
+
+// SetSelector sets the Selector used by this Balancer for the SRV name. It is the Balancer
+// equivalent of the package-level SetSelector() function.
+func (t *Balancer) SetSelector(srvName string, s Selector) {
+	t.cslb.setSelector(srvName, s)
+}
+
+// Options returns a copy of the Options in use by the Balancer - including any defaults that were
+// applied by New().
+func (t *Balancer) Options() Options {
+	return t.cslb.Options
+}
+
+// Stop stops the cache cleaners and status server started by New(). Transports enabled by this
+// Balancer continue to function but cache entries are no longer aged out. Stop must only be called
+// once.
+func (t *Balancer) Stop() {
+	t.cslb.stop()
+}
@@ -0,0 +1,68 @@
+package cslb
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test that New() applies supplied Options, fills in defaults and ignores the environment.
+func TestBalancerNew(t *testing.T) {
+	os.Setenv(cslbEnvPrefix+"options", "C")
+	os.Setenv(cslbEnvPrefix+"srv_ttl", "20m")
+	defer unsetAll()
+
+	lb := New(Options{FoundSRVTTL: time.Minute, HealthCheckContentOk: "READY", PrintSRVLookup: true})
+	defer lb.Stop()
+
+	opts := lb.Options()
+	if opts.FoundSRVTTL != time.Minute {
+		t.Error("FoundSRVTTL should be from Options, not", opts.FoundSRVTTL)
+	}
+	if opts.HealthCheckContentOk != "READY" {
+		t.Error("HealthCheckContentOk should be from Options, not", opts.HealthCheckContentOk)
+	}
+	if !opts.PrintSRVLookup {
+		t.Error("PrintSRVLookup should be from Options")
+	}
+	if opts.DisableInterception {
+		t.Error("DisableInterception should not have been set from the environment")
+	}
+	if opts.NotFoundSRVTTL != defaultNotFoundSRVTTL || opts.HealthTTL != defaultHealthTTL ||
+		opts.HealthCheckTXTPrefix != defaultHealthCheckTXTPrefix {
+		t.Error("Zero-valued Options should have been set to defaults", opts)
+	}
+}
+
+// Test that each Balancer has its own caches which are independent of the package-level instance.
+func TestBalancerIsolation(t *testing.T) {
+	lb := New(Options{})
+	defer lb.Stop()
+
+	mr := newMockResolver()
+	mr.appendSRV("http", "tcp", "isolated.example.net", "realtarget", 8080, 1, 1)
+	lb.cslb.netResolver = mr
+	dialer := newMockDialer()
+	lb.cslb.systemDialContext = dialer.dialContext
+
+	ht := lb.Enable(&http.Transport{})
+	ht.DialContext(context.Background(), "tcp", "isolated.example.net:80")
+	if dialer.address() != "realtarget:8080" {
+		t.Error("Balancer transport did not dial SRV target, rather", dialer.address())
+	}
+
+	if lb.cslb.cloneStats().DialContext != 1 {
+		t.Error("Balancer stats should show one DialContext, not", lb.cslb.cloneStats().DialContext)
+	}
+	if lb.cslb == getCSLB() {
+		t.Fatal("Balancer should not share the package-level cslb")
+	}
+	getCSLB().srvStore.RLock()
+	_, ok := getCSLB().srvStore.cache["_http._tcp.isolated.example.net"]
+	getCSLB().srvStore.RUnlock()
+	if ok {
+		t.Error("Balancer lookup leaked into package-level srvStore")
+	}
+}
@@ -0,0 +1,161 @@
+package cslb
+
+/*
+Connections returned to the application are wrapped in a trackedConn so that cslb can see how many
+connections each target currently holds and how much traffic they carry. Without this cslb forgets
+about a connection as soon as dialIterate returns it.
+
+The counters live in a connStats which is shared by the ceHealth of the target and every trackedConn
+to that target. All connStats fields are accessed atomically so that Read and Write never take the
+healthStore lock. If a ceHealth expires from the cache while it still has open connections, its
+connStats is retired and adopted by the next ceHealth created for the same target so that the
+counts carry across cache entries.
+*/
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// connStats accumulates connection statistics for a target. Always use atomic access.
+type connStats struct {
+	open         int64 // Currently open connections
+	closed       int64 // Connections closed since the stats were created
+	bytesRead    int64 // Across all connections - open and closed
+	bytesWritten int64
+	lifetime     int64 // Sum of the lifetimes of closed connections in nanoseconds
+}
+
+// openConns returns the number of open connections. Safe to call with a nil connStats.
+func (t *connStats) openConns() int {
+	if t == nil {
+		return 0
+	}
+
+	return int(atomic.LoadInt64(&t.open))
+}
+
+// averageLifetime returns the average lifetime of closed connections.
+func (t *connStats) averageLifetime() time.Duration {
+	closed := atomic.LoadInt64(&t.closed)
+	if closed == 0 {
+		return 0
+	}
+
+	return time.Duration(atomic.LoadInt64(&t.lifetime) / closed)
+}
+
+// trackedConn is the net.Conn returned to the application for an SRV target.
+type trackedConn struct {
+	net.Conn
+	stats  *connStats
+	opened time.Time
+	closed int32 // Set once Close has been counted - use atomic
+}
+
+func (t *trackedConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	atomic.AddInt64(&t.stats.bytesRead, int64(n))
+
+	return n, err
+}
+
+func (t *trackedConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	atomic.AddInt64(&t.stats.bytesWritten, int64(n))
+
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom so that the splice/sendfile fast paths of the underlying
+// connection, e.g. a *net.TCPConn, are still used when the application calls io.Copy.
+func (t *trackedConn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := t.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{t.Conn}, r) // Hide ReadFrom to avoid recursion
+	}
+	atomic.AddInt64(&t.stats.bytesWritten, n)
+
+	return n, err
+}
+
+// WriteTo implements io.WriterTo for the same reason as ReadFrom.
+func (t *trackedConn) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	var err error
+	if wt, ok := t.Conn.(io.WriterTo); ok {
+		n, err = wt.WriteTo(w)
+	} else {
+		n, err = io.Copy(w, struct{ io.Reader }{t.Conn})
+	}
+	atomic.AddInt64(&t.stats.bytesRead, n)
+
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the underlying connection if it supports it, as
+// *net.TCPConn and *net.UnixConn do. The connection is still counted as open until Close.
+func (t *trackedConn) CloseWrite() error {
+	if cw, ok := t.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.New("cslb: underlying connection does not support CloseWrite")
+}
+
+// NetConn returns the underlying connection, as tls.Conn.NetConn does, so that applications can
+// reach connection-specific methods such as (*net.TCPConn).SetKeepAlive. Traffic which bypasses
+// the trackedConn is not counted.
+func (t *trackedConn) NetConn() net.Conn {
+	return t.Conn
+}
+
+// Close closes the underlying connection and counts the close exactly once, no matter how many
+// times the application calls Close.
+func (t *trackedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+		atomic.AddInt64(&t.stats.open, -1)
+		atomic.AddInt64(&t.stats.closed, 1)
+		atomic.AddInt64(&t.stats.lifetime, int64(time.Since(t.opened)))
+	}
+
+	return t.Conn.Close()
+}
+
+// trackConn wraps the connection to the target so that it is counted by the target's connStats.
+// The connection is returned unwrapped if the target is unknown, which should never happen as
+// setDialResult has just created it if need be.
+func (t *cslb) trackConn(now time.Time, host string, port int, conn net.Conn) net.Conn {
+	t.healthStore.RLock()
+	ceh := t.healthStore.cache[makeHealthStoreKey(host, port)]
+	var stats *connStats
+	if ceh != nil {
+		stats = ceh.conns
+	}
+	t.healthStore.RUnlock()
+	if stats == nil {
+		return conn
+	}
+
+	atomic.AddInt64(&stats.open, 1)
+
+	return &trackedConn{Conn: conn, stats: stats, opened: now}
+}
+
+// adoptConnStats returns the connStats retired by a previous ceHealth for the target or a new
+// connStats if there is none. Caller must hold the healthStore lock.
+func (t *healthCache) adoptConnStats(healthStoreKey string) *connStats {
+	stats := t.retired[healthStoreKey]
+	if stats == nil {
+		return &connStats{}
+	}
+	delete(t.retired, healthStoreKey)
+
+	return stats
+}
@@ -0,0 +1,151 @@
+package cslb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnTracking(t *testing.T) {
+	cslb := realInit()
+	cslb.DisableHealthChecks = true
+	now := time.Now()
+	cslb.populateHealthStore(now, "", []string{"s1.example.net:80"})
+	stats := cslb.healthStore.cache["s1.example.net:80"].conns
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := cslb.trackConn(now.Add(-time.Second), "s1.example.net", 80, c1)
+	if stats.openConns() != 1 {
+		t.Error("Expected one open connection, not", stats.openConns())
+	}
+
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(c2, buf)
+		c2.Write([]byte("abc"))
+	}()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 3)
+	io.ReadFull(conn, buf)
+	if atomic.LoadInt64(&stats.bytesWritten) != 5 || atomic.LoadInt64(&stats.bytesRead) != 3 {
+		t.Error("Byte counts wrong", stats.bytesWritten, stats.bytesRead)
+	}
+
+	conn.Close()
+	conn.Close() // A second close must not be counted
+	if stats.openConns() != 0 || atomic.LoadInt64(&stats.closed) != 1 {
+		t.Error("Expected zero open and one closed connection", stats.openConns(), stats.closed)
+	}
+	if stats.averageLifetime() < time.Second {
+		t.Error("Expected lifetime of at least one second, not", stats.averageLifetime())
+	}
+
+	if unknown := cslb.trackConn(now, "s2.example.net", 80, c1); unknown != c1 {
+		t.Error("Connection to unknown target should not be wrapped")
+	}
+}
+
+// Test that connStats of an expired target carry over to its next ceHealth
+func TestConnRetire(t *testing.T) {
+	cslb := realInit()
+	cslb.DisableHealthChecks = true
+	yesterday := time.Now().AddDate(0, 0, -1)
+	cslb.populateHealthStore(yesterday, "", []string{"s1.example.net:80", "s2.example.net:80"})
+	stats := cslb.healthStore.cache["s1.example.net:80"].conns
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := cslb.trackConn(yesterday, "s1.example.net", 80, c1)
+
+	cslb.healthStore.clean(time.Now())
+	if len(cslb.healthStore.cache) != 0 || len(cslb.healthStore.retired) != 1 {
+		t.Fatal("Expected both entries cleaned and one retired", len(cslb.healthStore.cache),
+			len(cslb.healthStore.retired))
+	}
+
+	cslb.populateHealthStore(time.Now(), "", []string{"s1.example.net:80"})
+	if cslb.healthStore.cache["s1.example.net:80"].conns != stats || len(cslb.healthStore.retired) != 0 {
+		t.Error("Expected new entry to adopt retired connStats")
+	}
+
+	conn.Close()
+	cslb.healthStore.retired["s3.example.net:80"] = &connStats{} // No open connections
+	cslb.healthStore.clean(time.Now())
+	if len(cslb.healthStore.retired) != 0 {
+		t.Error("Retired connStats with no open connections should be cleaned")
+	}
+}
+
+// Test that open connections are seen by the least connections Selector
+func TestConnLeastConns(t *testing.T) {
+	mr := newMockResolver()
+	mr.appendSRV("http", "tcp", "example.org", "a1.example.org", 80, 1, 10)
+	mr.appendSRV("http", "tcp", "example.org", "a2.example.org", 80, 1, 10)
+	cslb := realInit()
+	cslb.netResolver = mr
+	cslb.DisableHealthChecks = true
+	cslb.Selector = newTestSelector(t, SelectorLeastConns)
+
+	now := time.Now()
+	cesrv := cslb.lookupSRV(context.Background(), now, "http", "tcp", "example.org")
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := cslb.trackConn(now, "a1.example.org", 80, c1)
+	for ix := 0; ix < 5; ix++ {
+		if srv := cslb.bestTarget(cesrv); srv.Target != "a2.example.org" {
+			t.Error("Expected target without connections, not", srv.Target)
+		}
+	}
+	conn.Close()
+}
+
+// Test that the underlying connection and its optional methods are reachable through the wrapper
+func TestConnForwarding(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			io.Copy(c, c) // Echo until CloseWrite from the client
+			c.Close()
+		}
+	}()
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cslb := realInit()
+	cslb.DisableHealthChecks = true
+	now := time.Now()
+	cslb.populateHealthStore(now, "", []string{"s1.example.net:80"})
+	stats := cslb.healthStore.cache["s1.example.net:80"].conns
+	conn := cslb.trackConn(now, "s1.example.net", 80, raw)
+	defer conn.Close()
+
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); !ok || nc.NetConn() != raw {
+		t.Error("Expected NetConn to return the underlying connection")
+	}
+	if n, err := io.Copy(conn, strings.NewReader("hello")); n != 5 || err != nil {
+		t.Fatal("ReadFrom failed", n, err)
+	}
+	if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal("CloseWrite failed", err)
+	}
+	var buf bytes.Buffer
+	if n, err := io.Copy(&buf, conn); n != 5 || err != nil || buf.String() != "hello" {
+		t.Error("WriteTo failed", n, err, buf.String())
+	}
+	if atomic.LoadInt64(&stats.bytesWritten) != 5 || atomic.LoadInt64(&stats.bytesRead) != 5 {
+		t.Error("Byte counts wrong", stats.bytesWritten, stats.bytesRead)
+	}
+}
@@ -2,10 +2,15 @@ package cslb
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -17,29 +22,47 @@ type limitedResolver interface {
 	LookupTXT(ctx context.Context, name string) ([]string, error)
 }
 
+// dialContextFunc is the signature shared by net.Dialer.DialContext and http.Transport.DialContext.
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 const (
 	cslbEnvPrefix               = "cslb_"   // All cslb environment variables are prefixed with this
 	defaultHealthCheckTXTPrefix = "._cslb." // Prepended to target name to form a TXT qName containing URL
 
 	defaultHealthCheckContentOk = "OK"             // Must be in the body of a good health check response
 	defaultHealthCheckFrequency = time.Second * 50 // How often to run the health check query
+	defaultHealthCheckTimeout   = time.Second * 10 // Maximum duration of a single health check
+	defaultHealthCheckMaxBody   = 64 * 1024        // Maximum health check response body read
+	defaultHealthCheckIdleConns = 1                // Idle health check connections kept per host
+	defaultHealthCheckIdleTime  = time.Second * 90 // How long an idle health check connection is kept
+	defaultHealthCheckRise      = 1                // Consecutive successes before a target is healthy
+	defaultHealthCheckFall      = 1                // Consecutive failures before a target is unhealthy
+	defaultHealthCheckWorkers   = 8                // Maximum concurrent health checks
 	defaultInterceptTimeout     = time.Minute      // Default context duration for dialContextIntercept
-	defaultDialVetoDuration     = time.Minute      // Ignore targets for this duration after dial fails
+	defaultDialVetoDuration     = time.Minute      // Minimum veto of a target after dial fails
+	defaultDialVetoMaxDuration  = time.Minute * 10 // Maximum veto of a target after repeated dial fails
+	defaultSRVRefreshAhead      = time.Second * 5  // Re-fetch active SRVs this long before they expire
 
 	// We need to configure our own TTLs because the go DNS APIs don't return TTLs. Most DNS
 	// libraries don't, but they all should as it is vital data for long-running programs that
 	// mistakenly hold onto a DNS results for the lifetime of the program istead of the lifetime
-	// of the DNS response.
-
-	defaultNotFoundSRVTTL = time.Minute * 20 // How long a NXDomain SRV is retained in the cache
-	defaultFoundSRVTTL    = time.Minute * 5  // How long a found SRV is retained in the cache
-	defaultHealthTTL      = time.Minute * 5  // How long a target stays in the cache
+	// of the DNS response. If the built-in resolver is configured with DNSServers these are only
+	// used when the response has no TTL - such as a negative response with no SOA.
+
+	defaultNotFoundSRVTTL  = time.Minute * 20 // How long a NXDomain SRV is retained in the cache
+	defaultFoundSRVTTL     = time.Minute * 5  // How long a found SRV is retained in the cache
+	defaultHealthTTL       = time.Minute * 5  // How long a target stays in the cache
+	defaultTransientSRVTTL = time.Second * 30 // How long a failed SRV lookup is retained in the cache
+	defaultSRVStaleLimit   = time.Hour        // How long past expiry found SRV targets may be served
 )
 
-// Config parameters manipulated by tests or possibly external options
-type config struct {
-	Version string
-
+// Options contains all the values which control the behaviour of a cslb instance created with
+// New(). Any zero-valued durations or strings are replaced with the package defaults so callers
+// need only set the values they care about. Durations and thresholds outside the limits applied to
+// the "cslb_*" environment variables are also replaced with the package defaults. Options are *not*
+// over-ridden by the "cslb_*" environment variables as those only apply to the package-level
+// instance created at init.
+type Options struct {
 	PrintDialContext bool // "d" - diagnostics settings are lowercase
 	PrintHCResults   bool // "h"
 	PrintIntercepts  bool // "i"
@@ -48,7 +71,9 @@ type config struct {
 
 	DisableInterception  bool // "C" - behaviour settings are uppercase
 	DisableHealthChecks  bool // "H"
+	PreferLowLatency     bool // "L"
 	AllowNumericServices bool // "N"
+	HealthCheckRTT       bool // "R"
 
 	StatusServerAddress   string // Listen address of status server
 	StatusServerTemplates string // filepath.Glob of replacement templates for status server
@@ -56,12 +81,53 @@ type config struct {
 	HealthCheckTXTPrefix string // Prepended to target name to form a TXT URL
 	HealthCheckContentOk string // Must be in the body of the health check response
 	HealthCheckFrequency time.Duration
+	HealthCheckRise      int           // Consecutive successful checks before target is reinstated
+	HealthCheckFall      int           // Consecutive failed checks before target is removed
+	HealthCheckTimeout   time.Duration // Maximum duration of a single health check
+	HealthCheckMaxBody   int64         // Maximum bytes of a health check response body which are read
+	HealthCheckWorkers   int           // Maximum number of health checks run concurrently
+
+	HealthCheckMaxIdleConns int           // Idle health check connections kept per host
+	HealthCheckIdleTimeout  time.Duration // How long an idle health check connection is kept
+
+	// HealthCheckTLSConfig is used by https and tls health checks. It can supply a custom root
+	// CA and client certificates for mTLS health check endpoints. If nil, a config is created
+	// from the "cslb_hc_ca", "cslb_hc_cert" and "cslb_hc_key" environment variables, if set,
+	// otherwise the system defaults apply.
+	HealthCheckTLSConfig *tls.Config
 	InterceptTimeout     time.Duration // Maximum time to run connect attempts with an intercept call
-	DialVetoDuration     time.Duration // Ignore targets for this duration after dial fails
+	DialVetoDuration     time.Duration // Minimum veto of a target after dial fails
+	DialVetoMaxDuration  time.Duration // Maximum veto of a target after repeated dial fails
+	SRVRefreshAhead      time.Duration // Re-fetch active SRVs this long before they expire
 
 	NotFoundSRVTTL time.Duration // How long a not-found SRV is retained in the cache
 	FoundSRVTTL    time.Duration // How long a found SRV is retained in the cache
 	HealthTTL      time.Duration // How long a target stays in the cache
+
+	// TransientSRVTTL is how long a timeout, SERVFAIL or similar DNS failure is retained in the
+	// cache. During this time the targets from the previous cache entry, if any, are used.
+	TransientSRVTTL time.Duration
+
+	// SRVStaleLimit is how long past its expiry the targets of a found SRV continue to be served
+	// while DNS lookups fail with transient errors. See RFC8767.
+	SRVStaleLimit time.Duration
+
+	// Selector chooses between the healthy targets of an SRV priority. If nil, targets are
+	// selected by RFC2782 weighted random. See NewSelector() for the built-in Selectors.
+	Selector Selector
+
+	// DNSServers is a comma separated list of recursive DNS servers (host or host:port) used by
+	// the built-in resolver. The built-in resolver returns the real DNS TTLs. If empty, the go
+	// resolver is used and the TTLs above apply.
+	DNSServers string
+}
+
+// Config parameters manipulated by tests or possibly external options
+type config struct {
+	Version string
+	Options
+
+	DisableDefaultTransport bool // "D" - only meaningful for the package-level instance
 }
 
 // cslbStats holds all statistics for the cslb package. See addStats() for typical usage.
@@ -69,6 +135,7 @@ type cslbStats struct {
 	StartTime       time.Time
 	Duration        time.Duration // Total elapse time in DialContext
 	DialContext     int           // intercepted calls to DialContext
+	DialService     int           // calls to Dialer.DialService
 	MissHostService int           // Host or service don't match or interception disabled
 	NoSRV           int           // Times SRV lookup returned zero targets
 	BestTarget      int           // Calls to bestTarget()
@@ -76,6 +143,13 @@ type cslbStats struct {
 	GoodDials       int           // system DialContext returned a good connection
 	FailedDials     int           // system DialContext returned an error
 	Deadline        int           // Times intercept deadline expired
+	AbandonedConns  int           // Late connections closed because the intercept had already returned
+	SRVRefreshes    int           // Active SRVs re-fetched ahead of expiry
+	CoalescedSRV    int           // SRV cache misses which waited on another go-routine's lookup
+	TransientSRV    int           // SRV lookups which failed with a transient DNS error
+	StaleSRV        int           // Transient SRV lookups answered with the previous targets
+	HealthChecks    int           // Health checks run by the scheduler
+	LateChecks      int           // Health checks which started more than a second late
 }
 
 // cloneStats creates a safe copy of the stats - primarily for the status server
@@ -100,6 +174,7 @@ func (t *cslb) addStats(ls *cslbStats) {
 	}
 
 	t.DialContext += ls.DialContext
+	t.DialService += ls.DialService
 	t.MissHostService += ls.MissHostService
 	t.NoSRV += ls.NoSRV
 	t.BestTarget += ls.BestTarget
@@ -107,6 +182,13 @@ func (t *cslb) addStats(ls *cslbStats) {
 	t.GoodDials += ls.GoodDials
 	t.FailedDials += ls.FailedDials
 	t.Deadline += ls.Deadline
+	t.AbandonedConns += ls.AbandonedConns
+	t.SRVRefreshes += ls.SRVRefreshes
+	t.CoalescedSRV += ls.CoalescedSRV
+	t.TransientSRV += ls.TransientSRV
+	t.StaleSRV += ls.StaleSRV
+	t.HealthChecks += ls.HealthChecks
+	t.LateChecks += ls.LateChecks
 }
 
 // cslb is the main structure which holds all the state for the life of the application. The main
@@ -116,23 +198,57 @@ type cslb struct {
 	config
 
 	netResolver       limitedResolver // Replaceable functions for test mocks
-	netDialer         *net.Dialer     // Not used - only here in case we later decide to modify Dialer values
-	systemDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
-	randIntn          func(int) int // Sufficient rand function used to select weight by bestTarget()
+	netDialer         *net.Dialer     // Only used by transports which had no DialContext prior to Enable
+	systemDialContext dialContextFunc // Default underlying dialer when there is nothing to chain to
+	randIntn          func(int) int   // Sufficient rand function used to select weight by bestTarget()
 
 	srvStore    *srvCache
 	healthStore *healthCache
+	hcScheduler *hcScheduler // Runs all health checks
 
 	statusServer *statusServer // Optional status web server
 	hcClient     *http.Client  // Shared Health Check Client - it purposely avoids a cslb-intercepted transport
 
+	checkersMu     sync.RWMutex             // Protects healthCheckers
+	healthCheckers map[string]HealthChecker // Keyed by URL scheme or SRV service name
+
+	selectorsMu        sync.RWMutex        // Protects selectors
+	selectors          map[string]Selector // Per-SRV Selectors keyed by srvStore key
+	signalledSelectors map[string]Selector // Read-only instances of built-ins signalled by SRV weights
+
 	statsMu sync.RWMutex // Protects everything below here
 	cslbStats
 }
 
-// newCslb is the cslb constructor. It must be used in preference to a raw &cslb{} construction as
-// there are numerous variables which must be set for any cslb methods to work.
+// newCslb is the cslb constructor for the package-level instance. It must be used in preference to
+// a raw &cslb{} construction as there are numerous variables which must be set for any cslb methods
+// to work. Default config values are over-ridden by any "cslb_*" environment variables.
 func newCslb() *cslb {
+	t := newBareCslb()
+	t.setDefaults()
+	t.loadEnv()
+	t.validate()
+	t.setResolver()
+	t.setHealthCheckClient()
+
+	return t
+}
+
+// newCslbWithOptions is the constructor used by New(). The caller-supplied Options replace the
+// defaults and the environment is ignored.
+func newCslbWithOptions(opts Options) *cslb {
+	t := newBareCslb()
+	t.Options = opts
+	t.setDefaults()
+	t.validate()
+	t.setResolver()
+	t.setHealthCheckClient()
+
+	return t
+}
+
+// newBareCslb creates a cslb with all the internal plumbing set but with an empty config.
+func newBareCslb() *cslb {
 	t := &cslb{}
 	t.netResolver = net.DefaultResolver
 	t.netDialer = &net.Dialer{ // Set up a net.Dialer identical to the
@@ -146,24 +262,168 @@ func newCslb() *cslb {
 
 	t.srvStore = newSrvCache()
 	t.healthStore = newHealthCache()
-	t.hcClient = &http.Client{Transport: &http.Transport{}} // Use a non-cslb http.Transport
-
-	// Transfer in all the default config values and then over-ride them
+	t.hcScheduler = newHCScheduler()
+	t.healthCheckers = map[string]HealthChecker{
+		"tcp": &tcpHealthChecker{dialer: &net.Dialer{}},
+		"tls": &tlsHealthChecker{dialer: &net.Dialer{}, config: &tls.Config{}},
+	}
+	t.selectors = make(map[string]Selector)
+	t.signalledSelectors = make(map[string]Selector)
+	for _, name := range encodedAlgorithms {
+		if len(name) > 0 {
+			t.signalledSelectors[name], _ = newSelector(name, func(n int) int { return t.randIntn(n) })
+		}
+	}
 
 	t.Version = Version
+	t.StartTime = time.Now()
 
-	t.HealthCheckTXTPrefix = defaultHealthCheckTXTPrefix
-	t.HealthCheckContentOk = defaultHealthCheckContentOk
-	t.HealthCheckFrequency = defaultHealthCheckFrequency
-	t.InterceptTimeout = defaultInterceptTimeout
-	t.DialVetoDuration = defaultDialVetoDuration
+	return t
+}
+
+// setDefaults transfers in the default config value for any config value which is not yet set.
+func (t *cslb) setDefaults() {
+	setDefaultString(&t.HealthCheckTXTPrefix, defaultHealthCheckTXTPrefix)
+	setDefaultString(&t.HealthCheckContentOk, defaultHealthCheckContentOk)
+	setDefaultDuration(&t.HealthCheckFrequency, defaultHealthCheckFrequency)
+	setDefaultDuration(&t.HealthCheckTimeout, defaultHealthCheckTimeout)
+	setDefaultInt64(&t.HealthCheckMaxBody, defaultHealthCheckMaxBody)
+	setDefaultInt(&t.HealthCheckMaxIdleConns, defaultHealthCheckIdleConns)
+	setDefaultDuration(&t.HealthCheckIdleTimeout, defaultHealthCheckIdleTime)
+	setDefaultInt(&t.HealthCheckRise, defaultHealthCheckRise)
+	setDefaultInt(&t.HealthCheckFall, defaultHealthCheckFall)
+	setDefaultInt(&t.HealthCheckWorkers, defaultHealthCheckWorkers)
+	setDefaultDuration(&t.InterceptTimeout, defaultInterceptTimeout)
+	setDefaultDuration(&t.DialVetoDuration, defaultDialVetoDuration)
+	setDefaultDuration(&t.DialVetoMaxDuration, defaultDialVetoMaxDuration)
+	setDefaultDuration(&t.SRVRefreshAhead, defaultSRVRefreshAhead)
+
+	setDefaultDuration(&t.NotFoundSRVTTL, defaultNotFoundSRVTTL)
+	setDefaultDuration(&t.FoundSRVTTL, defaultFoundSRVTTL)
+	setDefaultDuration(&t.HealthTTL, defaultHealthTTL)
+	setDefaultDuration(&t.TransientSRVTTL, defaultTransientSRVTTL)
+	setDefaultDuration(&t.SRVStaleLimit, defaultSRVStaleLimit)
+}
 
-	t.NotFoundSRVTTL = defaultNotFoundSRVTTL
-	t.FoundSRVTTL = defaultFoundSRVTTL
-	t.HealthTTL = defaultHealthTTL
+// setResolver replaces the go resolver with the built-in resolver if DNSServers are configured.
+func (t *cslb) setResolver() {
+	if len(t.DNSServers) > 0 {
+		t.netResolver = newDNSResolver(t.DNSServers)
+	}
+}
 
-	// Check for environment variable over-rides
+// setHealthCheckClient creates the health check http.Client and the tls HealthChecker from the
+// config. The client purposely uses a non-cslb http.Transport so that health checks are never
+// intercepted.
+func (t *cslb) setHealthCheckClient() {
+	tlsConfig := t.HealthCheckTLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	t.hcClient = &http.Client{Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: t.HealthCheckTimeout}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: t.HealthCheckTimeout,
+		MaxIdleConnsPerHost: t.HealthCheckMaxIdleConns,
+		IdleConnTimeout:     t.HealthCheckIdleTimeout,
+	}}
+	t.healthCheckers["tls"] = &tlsHealthChecker{dialer: &net.Dialer{}, config: tlsConfig}
+}
+
+// loadTLSConfig creates a tls.Config from PEM files. The CA file replaces the system roots and the
+// cert and key files are the client certificate presented to mTLS health check endpoints. Any of
+// the file names may be empty.
+func loadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func setDefaultString(s *string, def string) {
+	if len(*s) == 0 {
+		*s = def
+	}
+}
 
+// validate replaces config values which fall outside the limits applied to the "cslb_*"
+// environment variables with their defaults, then adjusts values which are only invalid in
+// combination with others. It is called once all defaults, Options and environment variables have
+// been applied so that Options supplied to New() are held to the same limits as the environment.
+// Without this, a tiny SRVRefreshAhead, say, results in a zero ticker interval and a panic.
+func (t *cslb) validate() {
+	for _, d := range []struct {
+		value *time.Duration
+		def   time.Duration
+	}{
+		{&t.HealthCheckFrequency, defaultHealthCheckFrequency},
+		{&t.HealthCheckTimeout, defaultHealthCheckTimeout},
+		{&t.InterceptTimeout, defaultInterceptTimeout},
+		{&t.DialVetoDuration, defaultDialVetoDuration},
+		{&t.DialVetoMaxDuration, defaultDialVetoMaxDuration},
+		{&t.SRVRefreshAhead, defaultSRVRefreshAhead},
+		{&t.NotFoundSRVTTL, defaultNotFoundSRVTTL},
+		{&t.FoundSRVTTL, defaultFoundSRVTTL},
+		{&t.HealthTTL, defaultHealthTTL},
+		{&t.TransientSRVTTL, defaultTransientSRVTTL},
+		{&t.SRVStaleLimit, defaultSRVStaleLimit},
+	} {
+		if *d.value < lowerDurationLimit || *d.value > upperDurationLimit {
+			*d.value = d.def
+		}
+	}
+	limitInt(&t.HealthCheckRise, defaultHealthCheckRise, lowerThresholdLimit, upperThresholdLimit)
+	limitInt(&t.HealthCheckFall, defaultHealthCheckFall, lowerThresholdLimit, upperThresholdLimit)
+	limitInt(&t.HealthCheckWorkers, defaultHealthCheckWorkers, lowerWorkersLimit, upperWorkersLimit)
+
+	if t.DialVetoMaxDuration < t.DialVetoDuration { // Never cap an existing DialVetoDuration
+		t.DialVetoMaxDuration = t.DialVetoDuration
+	}
+}
+
+// limitInt replaces the value with the default if it falls outside the lower and upper limits.
+func limitInt(i *int, def, lower, upper int) {
+	if *i < lower || *i > upper {
+		*i = def
+	}
+}
+
+func setDefaultInt(i *int, def int) {
+	if *i <= 0 {
+		*i = def
+	}
+}
+
+func setDefaultInt64(i *int64, def int64) {
+	if *i <= 0 {
+		*i = def
+	}
+}
+
+func setDefaultDuration(d *time.Duration, def time.Duration) {
+	if *d == 0 {
+		*d = def
+	}
+}
+
+// loadEnv over-rides config values with any "cslb_*" environment variables.
+func (t *cslb) loadEnv() {
 	flags := os.Getenv(cslbEnvPrefix + "options")
 	for _, opt := range []byte(flags) {
 		switch opt {
@@ -180,10 +440,16 @@ func newCslb() *cslb {
 
 		case 'C':
 			t.DisableInterception = true
+		case 'D':
+			t.DisableDefaultTransport = true
 		case 'H':
 			t.DisableHealthChecks = true
+		case 'L':
+			t.PreferLowLatency = true
 		case 'N':
 			t.AllowNumericServices = true
+		case 'R':
+			t.HealthCheckRTT = true
 		default:
 		}
 	}
@@ -193,28 +459,54 @@ func newCslb() *cslb {
 		t.HealthCheckContentOk = e
 	}
 
+	caFile := os.Getenv(cslbEnvPrefix + "hc_ca")
+	certFile := os.Getenv(cslbEnvPrefix + "hc_cert")
+	keyFile := os.Getenv(cslbEnvPrefix + "hc_key")
+	if len(caFile) > 0 || len(certFile) > 0 || len(keyFile) > 0 {
+		config, err := loadTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			log.Print("cslb Warning:", err) // Not fatal as health checks fail safe
+		} else {
+			t.HealthCheckTLSConfig = config
+		}
+	}
+
+	if e := os.Getenv(cslbEnvPrefix + "selector"); len(e) > 0 {
+		if s, err := NewSelector(e); err == nil {
+			t.Selector = s
+		}
+	}
+
+	t.DNSServers = os.Getenv(cslbEnvPrefix + "dns")
 	t.StatusServerAddress = os.Getenv(cslbEnvPrefix + "listen")
 	t.StatusServerTemplates = os.Getenv(cslbEnvPrefix + "templates")
 
 	t.HealthCheckFrequency = getAndParseDuration(cslbEnvPrefix+"hc_freq", t.HealthCheckFrequency)
+	t.HealthCheckTimeout = getAndParseDuration(cslbEnvPrefix+"hc_timeout", t.HealthCheckTimeout)
+	t.HealthCheckRise = parseThreshold(os.Getenv(cslbEnvPrefix+"hc_rise"), t.HealthCheckRise)
+	t.HealthCheckFall = parseThreshold(os.Getenv(cslbEnvPrefix+"hc_fall"), t.HealthCheckFall)
+	t.HealthCheckWorkers = parseLimitedInt(os.Getenv(cslbEnvPrefix+"hc_workers"), t.HealthCheckWorkers,
+		lowerWorkersLimit, upperWorkersLimit)
 	t.InterceptTimeout = getAndParseDuration(cslbEnvPrefix+"timeout", t.InterceptTimeout)
 	t.DialVetoDuration = getAndParseDuration(cslbEnvPrefix+"dial_veto", t.DialVetoDuration)
+	t.DialVetoMaxDuration = getAndParseDuration(cslbEnvPrefix+"veto_max", t.DialVetoMaxDuration)
+	t.SRVRefreshAhead = getAndParseDuration(cslbEnvPrefix+"srv_refresh", t.SRVRefreshAhead)
 
 	t.NotFoundSRVTTL = getAndParseDuration(cslbEnvPrefix+"nxd_ttl", t.NotFoundSRVTTL)
 	t.FoundSRVTTL = getAndParseDuration(cslbEnvPrefix+"srv_ttl", t.FoundSRVTTL)
 	t.HealthTTL = getAndParseDuration(cslbEnvPrefix+"tar_ttl", t.HealthTTL)
-
-	t.StartTime = time.Now()
-
-	return t
+	t.TransientSRVTTL = getAndParseDuration(cslbEnvPrefix+"err_ttl", t.TransientSRVTTL)
+	t.SRVStaleLimit = getAndParseDuration(cslbEnvPrefix+"stale", t.SRVStaleLimit)
 }
 
-// start starts up the cache cleaners and optionally the status web server. It is called *after* all
-// config settings have been over-ridden so as to avoid any race conditions - particularly with
-// tests.
+// start starts up the cache cleaners, the SRV refresher, the health check scheduler and optionally
+// the status web server. It is called *after* all config settings have been over-ridden so as to
+// avoid any race conditions - particularly with tests.
 func (t *cslb) start() *cslb {
 	t.srvStore.start((t.FoundSRVTTL / 5) + time.Second)
+	go t.refresher(t.SRVRefreshAhead / 2) // Tick often enough to catch every entry within the window
 	t.healthStore.start((t.HealthTTL / 5) + time.Second)
+	t.hcScheduler.start(t.HealthCheckWorkers, t.runHealthCheck)
 
 	if len(t.StatusServerAddress) > 0 {
 		t.statusServer = newStatusServer(t)
@@ -228,6 +520,7 @@ func (t *cslb) start() *cslb {
 func (t *cslb) stop() {
 	t.srvStore.stop()
 	t.healthStore.stop()
+	t.hcScheduler.stop()
 
 	if t.statusServer != nil {
 		t.statusServer.stop(context.Background())
@@ -238,22 +531,81 @@ func (t *cslb) stop() {
 const (
 	lowerDurationLimit = time.Second // Arbitrary limits to avoid
 	upperDurationLimit = time.Hour   // absurd values being used
+
+	lowerThresholdLimit = 1  // Same for rise and fall
+	upperThresholdLimit = 20 // thresholds
+
+	lowerWorkersLimit = 1    // Health check
+	upperWorkersLimit = 1000 // concurrency
+
+	lowerDNSTTLLimit = time.Second    // DNS TTLs are clamped to these limits so that a zero TTL
+	upperDNSTTLLimit = time.Hour * 24 // doesn't cause a lookup for every dial.
+
+	lowerSpecTimeoutLimit  = time.Millisecond * 10  // Health check TXT timeout= and interval=
+	lowerSpecIntervalLimit = time.Millisecond * 100 // are per-target probe settings so they can
+	upperSpecLimit         = time.Hour              // reasonably be sub-second.
 )
 
+// dnsTTL returns the DNS TTL clamped to reasonable limits or the default if there is no DNS TTL. A
+// TTL of zero is a real TTL and is clamped like any other.
+func dnsTTL(ttl, def time.Duration) time.Duration {
+	switch {
+	case ttl < 0: // noDNSTTL
+		return def
+	case ttl < lowerDNSTTLLimit:
+		return lowerDNSTTLLimit
+	case ttl > upperDNSTTLLimit:
+		return upperDNSTTLLimit
+	}
+
+	return ttl
+}
+
 // getAndParseDuration is a helper to get the env variable and convert it to a reasonable
 // duration. Returns the current value if the proposed value is outside reasonable limits.
 func getAndParseDuration(name string, currValue time.Duration) time.Duration {
-	e := os.Getenv(name)
-	if len(e) == 0 {
+	return parseDuration(os.Getenv(name), currValue)
+}
+
+// parseDuration converts the string to a reasonable duration. Returns the current value if the
+// string is empty, invalid or outside reasonable limits.
+func parseDuration(s string, currValue time.Duration) time.Duration {
+	return parseLimitedDuration(s, currValue, lowerDurationLimit, upperDurationLimit)
+}
+
+// parseLimitedDuration converts the string to a duration. Returns the current value if the string
+// is empty, invalid or outside the lower and upper limits.
+func parseLimitedDuration(s string, currValue, lower, upper time.Duration) time.Duration {
+	if len(s) == 0 {
 		return currValue
 	}
-	d, err := time.ParseDuration(e)
+	d, err := time.ParseDuration(s)
 	if err != nil {
 		return currValue
 	}
-	if d < lowerDurationLimit || d > upperDurationLimit {
+	if d < lower || d > upper {
 		return currValue
 	}
 
 	return d
 }
+
+// parseThreshold converts the string to a rise or fall threshold. Returns the current value if the
+// string is empty, invalid or outside reasonable limits.
+func parseThreshold(s string, currValue int) int {
+	return parseLimitedInt(s, currValue, lowerThresholdLimit, upperThresholdLimit)
+}
+
+// parseLimitedInt converts the string to an int. Returns the current value if the string is empty,
+// invalid or outside the lower and upper limits.
+func parseLimitedInt(s string, currValue, lower, upper int) int {
+	if len(s) == 0 {
+		return currValue
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < lower || i > upper {
+		return currValue
+	}
+
+	return i
+}
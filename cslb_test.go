@@ -14,6 +14,7 @@ func unsetAll() {
 	os.Unsetenv(cslbEnvPrefix + "hc_ok")
 
 	os.Unsetenv(cslbEnvPrefix + "dial_veto")
+	os.Unsetenv(cslbEnvPrefix + "veto_max")
 	os.Unsetenv(cslbEnvPrefix + "hc_freq")
 	os.Unsetenv(cslbEnvPrefix + "nxd_ttl")
 	os.Unsetenv(cslbEnvPrefix + "srv_ttl")
@@ -24,10 +25,11 @@ func unsetAll() {
 // Test that newCslb notices good env variables. This blows away any env variables that might have
 // been inherited by the test executable.
 func TestCSLBGoodOptions(t *testing.T) {
-	os.Setenv(cslbEnvPrefix+"options", "dhirsHCN")
+	os.Setenv(cslbEnvPrefix+"options", "dhirsCDHLNR")
 	os.Setenv(cslbEnvPrefix+"hc_ok", "BIG OK")
 
 	os.Setenv(cslbEnvPrefix+"dial_veto", "5m")
+	os.Setenv(cslbEnvPrefix+"veto_max", "1h")
 	os.Setenv(cslbEnvPrefix+"hc_freq", "10m")
 	os.Setenv(cslbEnvPrefix+"nxd_ttl", "15m")
 	os.Setenv(cslbEnvPrefix+"srv_ttl", "20m")
@@ -37,7 +39,8 @@ func TestCSLBGoodOptions(t *testing.T) {
 	cslb := newCslb()
 	if !cslb.PrintHCResults || !cslb.PrintIntercepts || !cslb.PrintSRVLookup || !cslb.PrintDialContext ||
 		!cslb.PrintDialResults || !cslb.DisableHealthChecks || !cslb.DisableInterception ||
-		!cslb.AllowNumericServices {
+		!cslb.AllowNumericServices || !cslb.DisableDefaultTransport || !cslb.PreferLowLatency ||
+		!cslb.HealthCheckRTT {
 		t.Error("At least one option not set", cslb.config)
 	}
 
@@ -47,6 +50,9 @@ func TestCSLBGoodOptions(t *testing.T) {
 	if cslb.DialVetoDuration != time.Minute*5 {
 		t.Error("DialVetoDuration not set")
 	}
+	if cslb.DialVetoMaxDuration != time.Hour {
+		t.Error("DialVetoMaxDuration not set")
+	}
 	if cslb.HealthCheckFrequency != time.Minute*10 {
 		t.Error("HealthCheckFrequency not set")
 	}
@@ -149,3 +155,18 @@ func TestCslbStartStop(t *testing.T) {
 		t.Error("Expected connection refused after cslb.stop()")
 	}
 }
+
+// Test that Options outside the environment limits are replaced with defaults so that start()
+// doesn't panic on a zero ticker interval.
+func TestCSLBValidateOptions(t *testing.T) {
+	cslb := newCslbWithOptions(Options{SRVRefreshAhead: time.Nanosecond, FoundSRVTTL: -time.Minute,
+		HealthCheckWorkers: 5000, HealthCheckRise: 3, DisableHealthChecks: true})
+	if cslb.SRVRefreshAhead != defaultSRVRefreshAhead || cslb.FoundSRVTTL != defaultFoundSRVTTL {
+		t.Error("Out of range durations should revert to defaults", cslb.SRVRefreshAhead, cslb.FoundSRVTTL)
+	}
+	if cslb.HealthCheckWorkers != defaultHealthCheckWorkers || cslb.HealthCheckRise != 3 {
+		t.Error("Only out of range ints should revert to defaults", cslb.HealthCheckWorkers, cslb.HealthCheckRise)
+	}
+	cslb.start()
+	cslb.stop()
+}
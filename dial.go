@@ -34,6 +34,23 @@ type dialResult struct {
 // which can be coded around to arrive at a workable compromise, but it's unclear the additional
 // complexity buys us very much and determining the benefit is tough.
 func (t *cslb) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return t.interceptDial(ctx, nil, network, address)
+}
+
+// chainDialContext returns a dialContext which uses the supplied "next" function as the underlying
+// dialer for both pass-thru and SRV target connections. A nil "next" means use systemDialContext.
+func (t *cslb) chainDialContext(next dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return t.interceptDial(ctx, next, network, address)
+	}
+}
+
+// interceptDial is the implementation of dialContext with the underlying dialer made explicit.
+func (t *cslb) interceptDial(ctx context.Context, next dialContextFunc, network, address string) (net.Conn, error) {
+	if next == nil {
+		next = t.systemDialContext
+	}
+
 	var ls cslbStats      // Accumulate stats locally then
 	defer t.addStats(&ls) // transfer to cslb at the end
 
@@ -43,45 +60,41 @@ func (t *cslb) dialContext(ctx context.Context, network, address string) (net.Co
 		fmt.Println("cslb.dialContext:intercept", network, address, "gives", host, "and", port)
 	}
 
-	// Convert the numeric port number back to a service name to formulate the SRV qName. This
-	// is error prone as there is not necessarily any correlation between the two. E.g. with
-	// http.Get("https://example.net:80/resource") the conversion results in qName of
-	// _http._tcp.example.net which is unlikely to be what the caller wanted, but what can you
-	// do? The problem is that the scheme on the original URL is not visible to us in any
-	// way. Hardly surprising since net.DialContent is a generalized service. The only real
-	// solution is if the net/http package were to introduce its own dialer interface which
-	// passes scheme and port down to the Dial functions.
-
-	service := ""
-	switch port { // Map services that we can enable (which is only net/http for now)
-	case "80":
-		service = "http"
-	case "443":
-		service = "https"
-	default:
-		if t.AllowNumericServices { // Are we allowed to try _1443._tcp.$domain ?
-			service = port
+	// If the caller has told us the service, typically via RoundTripper which knows the URL
+	// scheme, use that. Otherwise convert the numeric port number back to a service name to
+	// formulate the SRV qName. This is error prone as there is not necessarily any correlation
+	// between the two. E.g. with http.Get("https://example.net:80/resource") the conversion
+	// results in qName of _http._tcp.example.net which is unlikely to be what the caller
+	// wanted, but what can you do? The problem is that the scheme on the original URL is not
+	// visible to us in any way unless the RoundTripper is used. Hardly surprising since
+	// net.DialContent is a generalized service.
+
+	service, ok := serviceFromContext(ctx)
+	if !ok {
+		switch port { // Map services that we can enable (which is only net/http for now)
+		case "80":
+			service = "http"
+		case "443":
+			service = "https"
+		default:
+			if t.AllowNumericServices { // Are we allowed to try _1443._tcp.$domain ?
+				service = port
+			}
 		}
 	}
 
 	// Everything has to be "just right" before we run the intercept logic. If not, pass thru to
-	// the system dialContext and fuggedaboutit!
+	// the underlying dialContext and fuggedaboutit!
 	if len(host) == 0 || len(service) == 0 || t.DisableInterception {
 		ls.MissHostService++
-		return t.systemDialContext(ctx, network, address)
+		return next(ctx, network, address)
 	}
 
 	now := time.Now()
 	ls.StartTime = now
 
-	// If the supplied context does not have a deadline, derive WithTimeout context and set it
-	// with our configured timeout.
-
-	if deadline, ok := ctx.Deadline(); !ok || deadline.IsZero() {
-		subCtx, cancel := context.WithTimeout(ctx, t.InterceptTimeout)
-		defer cancel()
-		ctx = subCtx // The WithTimeout context becomes our default context
-	}
+	ctx, cancel := t.withInterceptTimeout(ctx)
+	defer cancel()
 
 	cesrv := t.lookupSRV(ctx, now, service, network, host)
 	if t.PrintSRVLookup {
@@ -89,33 +102,108 @@ func (t *cslb) dialContext(ctx context.Context, network, address string) (net.Co
 	}
 	if cesrv.uniqueTargets() == 0 { // Empty or non-existent SRV means revert to system Dailer
 		ls.NoSRV++
-		return t.systemDialContext(ctx, network, address)
+		return next(ctx, network, address)
+	}
+
+	return t.dialTargets(ctx, next, cesrv, network, address)
+}
+
+// dialService is the implementation of Dialer.DialService. It differs from interceptDial in that
+// the SRV name is supplied by the caller rather than deduced from an address and there is no
+// address to fall back to if the SRV has no targets.
+func (t *cslb) dialService(ctx context.Context, next dialContextFunc, service, proto, domain string) (net.Conn, error) {
+	if next == nil {
+		next = t.systemDialContext
+	}
+
+	var ls cslbStats
+	defer t.addStats(&ls)
+
+	ls.DialService++
+	now := time.Now()
+	ls.StartTime = now
+	service = strings.ToLower(service)
+	proto = strings.ToLower(proto)
+	domain = strings.ToLower(domain)
+	if t.PrintDialContext {
+		fmt.Println("cslb.dialService:", service, proto, domain)
 	}
 
+	ctx, cancel := t.withInterceptTimeout(ctx)
+	defer cancel()
+
+	cesrv := t.lookupSRV(ctx, now, service, proto, domain)
+	if t.PrintSRVLookup {
+		fmt.Println("cslb.dialService:lookupSRV", service, proto, domain, cesrv.uniqueTargets(), cesrv)
+	}
+	qName := "_" + service + "._" + proto + "." + domain
+	if cesrv.uniqueTargets() == 0 {
+		ls.NoSRV++
+		return nil, fmt.Errorf("cslb: No SRV targets for %s", qName)
+	}
+
+	return t.dialTargets(ctx, next, cesrv, proto, qName)
+}
+
+// withInterceptTimeout derives a WithTimeout context set with our configured timeout if the
+// supplied context does not have a deadline. The returned cancel function must always be called.
+func (t *cslb) withInterceptTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); !ok || deadline.IsZero() {
+		return context.WithTimeout(ctx, t.InterceptTimeout)
+	}
+
+	return ctx, func() {}
+}
+
+// dialTargets runs dialIterate over the SRV targets and returns the first good connection or an
+// error if all targets failed or the context expired. The address is only used for reporting.
+func (t *cslb) dialTargets(ctx context.Context, dial dialContextFunc, cesrv *ceSRV, network,
+	address string) (net.Conn, error) {
+	var ls cslbStats // Do not set StartTime for nested stats
+	defer t.addStats(&ls)
+
 	// Because we need to select on the cancel channel, run the iteration in a separate
 	// go-routine and have it return the results via a channel that we can also select on. The
-	// dialIterate function is responsible for closing the channel to ensure we don't leak.
+	// dialIterate function is responsible for closing the channel to ensure we don't leak. The
+	// channel is buffered so that dialIterate never blocks on a result we have given up on.
 
-	returned := make(chan dialResult)
-	go t.dialIterate(ctx, cesrv, network, address, returned)
+	returned := make(chan dialResult, 1)
+	go t.dialIterate(ctx, dial, cesrv, network, address, returned)
 	select {
 	case result := <-returned: // Some sort of response from dialIterate
 		return result.conn, result.err
 
 	case <-ctx.Done(): // Cancel or deadline exceeded
+		ls.Deadline++
+		go t.closeAbandoned(returned) // dialIterate may yet return a connection nobody wants
 		return nil, ctx.Err()
 	}
 
 	// NOT REACHED
 }
 
+// closeAbandoned waits for dialIterate to deliver its result after dialTargets has given up and
+// closes any connection which was obtained too late to be returned to the caller. dialIterate
+// always closes the channel so this go-routine always exits.
+func (t *cslb) closeAbandoned(returned chan dialResult) {
+	result, ok := <-returned
+	if ok && result.conn != nil {
+		result.conn.Close()
+		t.addStats(&cslbStats{AbandonedConns: 1})
+	}
+}
+
 // dialIterate iterates over bestTargets until it gets a good connection, runs out of time or runs
 // out of unique targets. Because a failed target is put at the bottom of the pile in terms of
 // isGood() and nextDialAttempt it should only recur if bestTarget() has cycled thru *all* possible
 // good targets and all targets with a closer nextDialAttempt.
 //
-// Results are returned via the result channel as we're started as a separate go-routine.
-func (t *cslb) dialIterate(ctx context.Context, cesrv *ceSRV, network, address string, result chan dialResult) {
+// Results are returned via the result channel as we're started as a separate go-routine. Exactly one
+// result is sent and the channel has a buffer of one so we never block even if our caller has given
+// up waiting. The iteration stops as soon as the context is done as there is no point dialing more
+// targets on behalf of a caller who has gone away.
+func (t *cslb) dialIterate(ctx context.Context, dial dialContextFunc, cesrv *ceSRV, network, address string,
+	result chan dialResult) {
 	var ls cslbStats // Do not set StartTime for nested stats
 	var lastError error
 
@@ -124,6 +212,10 @@ func (t *cslb) dialIterate(ctx context.Context, cesrv *ceSRV, network, address s
 
 	dupes := make(map[string]bool) // Track targets to detect bestTarget() cycling
 	for {
+		if err := ctx.Err(); err != nil {
+			result <- dialResult{nil, err}
+			return
+		}
 		ls.BestTarget++
 		srv := t.bestTarget(cesrv) // Returns a single synthesized *net.SRV with target
 		newAddress := fmt.Sprintf("%s:%d", srv.Target, int(srv.Port))
@@ -138,16 +230,19 @@ func (t *cslb) dialIterate(ctx context.Context, cesrv *ceSRV, network, address s
 		if t.PrintIntercepts {
 			fmt.Println("cslb.dialContext:SRV", address, "to target", network, newAddress)
 		}
-		nc, err := t.systemDialContext(ctx, network, newAddress)
+		t.beginDial(srv.Target, int(srv.Port))
+		start := time.Now()
+		nc, err := dial(ctx, network, newAddress)
 		lastError = err
 		now := time.Now()
 		t.setDialResult(now, srv.Target, int(srv.Port), err)
+		t.endDial(srv.Target, int(srv.Port), now.Sub(start), err)
 		if t.PrintDialResults {
 			fmt.Println("cslb.systemDialContext:Results", network, newAddress, err)
 		}
 		if err == nil { // Success!
 			ls.GoodDials++
-			result <- dialResult{nc, nil}
+			result <- dialResult{t.trackConn(now, srv.Target, int(srv.Port), nc), nil}
 			return
 		}
 		ls.FailedDials++
@@ -272,3 +272,39 @@ func TestDialCancel(t *testing.T) {
 		t.Error("Cancel did not terminate request within 2 seconds", dur)
 	}
 }
+
+// Test that a connection obtained after the intercept deadline has expired is closed rather than
+// leaked and that dialIterate exits.
+func TestDialAbandonedConnection(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	cslb.netResolver = mr
+	mr.appendSRV("https", "tcp", "localhost", "s1.localhost", 4000, 0, 0)
+	client, server := net.Pipe()
+	defer server.Close()
+	dialer := newMockDialer()
+	dialer.delay = time.Second / 2
+	dialer.conn = client
+	cslb.systemDialContext = dialer.dialContext
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel()
+	_, err := cslb.dialContext(ctx, "tcp", "localhost:443")
+	if err == nil {
+		t.Fatal("Expected a deadline error")
+	}
+
+	time.Sleep(time.Second) // Give the late dial a chance to complete and be closed
+	s := cslb.cloneStats()
+	if s.AbandonedConns != 1 || s.Deadline != 1 {
+		t.Error("Expected one AbandonedConns and one Deadline, not", s.AbandonedConns, s.Deadline)
+	}
+	server.SetDeadline(time.Now().Add(time.Second))
+	_, err = server.Write([]byte("x")) // Write to a closed pipe peer fails
+	if err == nil {
+		t.Error("Expected abandoned connection to have been closed")
+	}
+	if len(dialer.addressList()) != 1 {
+		t.Error("dialIterate should have stopped after the deadline, but dialed", dialer.addressList())
+	}
+}
@@ -0,0 +1,52 @@
+package cslb
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer makes cslb processing available to any client which accepts a DialContext style function,
+// such as gRPC, database and cache clients or plain TCP clients. The Dialer applies the same SRV
+// selection, health checks and dial vetoes as an enabled http.Transport, e.g.:
+//
+//	d := cslb.NewDialer(nil)
+//	conn, err := d.DialService(ctx, "ldap", "tcp", "example.net") // Dials a _ldap._tcp.example.net target
+//
+// As with net.Dialer, the zero value is ready to use. It uses the package-level cslb instance and the
+// default underlying dialer.
+type Dialer struct {
+	cslb *cslb
+	next dialContextFunc
+}
+
+// NewDialer creates a Dialer which uses the package-level cslb instance. The "next" function is the
+// underlying dialer used to connect to SRV targets and to pass-thru addresses. If "next" is nil, a
+// net.Dialer configured the same way as net/http configures its default dialer is used.
+func NewDialer(next func(ctx context.Context, network, addr string) (net.Conn, error)) *Dialer {
+	return &Dialer{cslb: getCSLB(), next: next}
+}
+
+// DialContext has the same semantics as an enabled http.Transport.DialContext. That is, the SRV
+// service name is taken from the context if set with WithService() otherwise it is deduced from the
+// port in the address. If no SRV exists the address is dialed directly.
+func (t *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return t.getCSLB().interceptDial(ctx, t.next, network, address)
+}
+
+// DialService dials the best target of the RFC2782 SRV _$service._$proto.$domain. The proto is also
+// used as the network for dialing the targets so it should be "tcp" or "udp" or one of their
+// variants. Unlike DialContext, an error is returned if the SRV has no targets as there is no
+// address to fall back to.
+func (t *Dialer) DialService(ctx context.Context, service, proto, domain string) (net.Conn, error) {
+	return t.getCSLB().dialService(ctx, t.next, service, proto, domain)
+}
+
+// getCSLB returns the cslb instance of the Dialer, which is the package-level instance for a zero
+// value Dialer.
+func (t *Dialer) getCSLB() *cslb {
+	if t.cslb == nil {
+		return getCSLB()
+	}
+
+	return t.cslb
+}
@@ -0,0 +1,83 @@
+package cslb
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// Test that DialService dials SRV targets for arbitrary service names and errors when there are no
+// targets.
+func TestDialerDialService(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	mr.appendSRV("ldap", "tcp", "example.net", "ldap1.example.net", 389, 1, 1)
+	cslb.netResolver = mr
+	dialer := newMockDialer()
+
+	d := NewDialer(dialer.dialContext)
+	_, err := d.DialService(context.Background(), "LDAP", "tcp", "Example.Net")
+	if err != nil {
+		t.Fatal("Unexpected error from DialService", err)
+	}
+	if mr.lastSRV != "_ldap._tcp.example.net" {
+		t.Error("DialService looked up the wrong SRV", mr.lastSRV)
+	}
+	if dialer.network() != "tcp" || dialer.address() != "ldap1.example.net:389" {
+		t.Error("DialService dialed the wrong target", dialer.network(), dialer.address())
+	}
+
+	dialer.reset()
+	_, err = d.DialService(context.Background(), "ldap", "tcp", "nosrv.example.net")
+	if err == nil || !strings.Contains(err.Error(), "No SRV targets") {
+		t.Error("Expected 'No SRV targets' error, not", err)
+	}
+	if len(dialer.addressList()) != 0 {
+		t.Error("Nothing should have been dialed", dialer.addressList())
+	}
+
+	s := cslb.cloneStats()
+	if s.DialService != 2 || s.NoSRV != 1 {
+		t.Error("Expected 2 DialService and 1 NoSRV, not", s.DialService, s.NoSRV)
+	}
+}
+
+// Test that DialContext behaves like an enabled transport.
+func TestDialerDialContext(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	mr.appendSRV("redis", "tcp", "example.net", "redis1.example.net", 6380, 1, 1)
+	cslb.netResolver = mr
+	dialer := newMockDialer()
+
+	d := NewDialer(dialer.dialContext)
+	d.DialContext(WithService(context.Background(), "redis"), "tcp", "example.net:6379")
+	if dialer.address() != "redis1.example.net:6380" {
+		t.Error("DialContext with service should have dialed SRV target, not", dialer.address())
+	}
+
+	d.DialContext(context.Background(), "tcp", "example.net:6379") // No service and non-standard port
+	if dialer.address() != "example.net:6379" {
+		t.Error("DialContext without service should have passed thru, not", dialer.address())
+	}
+}
+
+// Test that the zero value Dialer uses the package-level instance and the system dialer
+func TestDialerZeroValue(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	mr.appendSRV("ldap", "tcp", "example.net", "ldap1.example.net", 389, 1, 1)
+	cslb.netResolver = mr
+	system := newMockDialer()
+	cslb.systemDialContext = system.dialContext
+
+	var d Dialer
+	d.DialService(context.Background(), "ldap", "tcp", "example.net")
+	if system.address() != "ldap1.example.net:389" {
+		t.Error("Zero value Dialer should dial via the package-level instance, not", system.address())
+	}
+	d.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	if system.address() != "127.0.0.1:1" {
+		t.Error("Zero value Dialer DialContext failed", system.address())
+	}
+}
@@ -15,8 +15,8 @@ load-balancers!
 
 # DEFAULT USAGE
 
-Importing cslb automatically enables interception for http.DefaultTransport. In this program
-snippet:
+Importing cslb automatically enables interception for http.DefaultTransport (unless the 'D' run
+time option is set - see below). In this program snippet:
 
 	import (
 	        "net/http"
@@ -45,7 +45,33 @@ the cslb.Enable() function, i.e.:
 	        resp, err := client.Get("http://mydomain/resource")
 	        ...
 
-The cslb.Enable() function replaces http.Transport.DialContext with its own intercept function.
+The cslb.Enable() function replaces http.Transport.DialContext with its own intercept function. The
+cslb.Disable() function restores the original DialContext so that intercepted and non-intercepted
+transports can deliberately co-exist. Applications which want complete control over which transports
+are intercepted, including http.DefaultTransport, should set the 'D' run time option and call
+cslb.Enable() explicitly.
+
+# INDEPENDENT INSTANCES
+
+Applications which prefer to configure cslb from their own configuration system rather than via
+environment variables can create independent instances with cslb.New(). Each instance has its own
+caches, status server and statistics, i.e.:
+
+	lb := cslb.New(cslb.Options{FoundSRVTTL: time.Minute, DialVetoDuration: 10 * time.Second})
+	defer lb.Stop()
+	client := &http.Client{Transport: lb.Enable(&http.Transport{})}
+
+Zero-valued Options are replaced with the package defaults and the "cslb_*" environment variables
+are ignored.
+
+# NON HTTP USAGE
+
+Clients which are not based on net/http, such as gRPC, database and cache clients, can use cslb via
+a cslb.Dialer. Its DialContext method has the same signature as net.Dialer.DialContext and its
+DialService method dials the best target of any RFC2782 service name, i.e.:
+
+	d := cslb.NewDialer(nil)
+	conn, err := d.DialService(ctx, "ldap", "tcp", "example.net") // Uses _ldap._tcp.example.net
 
 # WHEN TO USE CSLB
 
@@ -68,10 +94,60 @@ directs the Dial Request to the highest preference target based on the SRV algor
 Request fails, it tries the next lower preference target until a successful connection is returned
 or all unique targets fail or it runs out of time.
 
+A target which fails a Dial Request is vetoed for a period which starts at DialVetoDuration and
+doubles with each consecutive failure, up to DialVetoMaxDuration, so that a dead target is only tried
+occasionally. The veto period has jitter added, always stays between the two durations and is
+reset by the first successful Dial Request. If DialVetoMaxDuration is less than DialVetoDuration it
+is raised to match.
+
 Cslb caches the SRV RRs (or their non-existence) as well as the result of Dial Requests to the SRV
 targets to optimize subequent intercepted calls and the selection of preferred targets. If no SRV
 RRs exist, cslb passes the Dial Request on to net.DialContext.
 
+# SELECTION ALGORITHMS
+
+By default the target within a priority is selected by the RFC2782 weighted random algorithm. An
+alternative Selector can be set for all SRVs with Options.Selector or the "cslb_selector"
+environment variable, or for a single SRV with cslb.SetSelector(), e.g.:
+
+	s, _ := cslb.NewSelector("leastconn")
+	cslb.SetSelector("_https._tcp.example.net", s)
+
+The built-in Selectors are:
+
+	random    - RFC2782 weighted random amongst the healthy targets
+	rr        - Round-robin, ignoring weight
+	wrr       - Smooth weighted round-robin
+	leastconn - Fewest open connections relative to weight
+	latency   - Lowest round trip time (RTT)
+	p2c       - The less loaded of two weighted random choices
+
+Whichever Selector applies, priorities are still honored and targets which have failed health checks
+or dial attempts are never offered to the Selector. Applications can supply their own Selector.
+
+The operator of a service can signal which built-in Selector clients should use by encoding it in
+the SRV weights. An encoded weight has the original weight (0-255) in the top eight bits, all ones
+in the next five bits and the algorithm in the bottom three bits, i.e. weight<<8 + 0x1F<<3 + alg:
+
+	0 = rr, 1 = latency, 2 = leastconn, 3 = wrr, 4 = p2c, 5-7 = reserved
+
+E.g. targets with weights 10, 15 and 20 which should use leastconn are published with the weights
+2810, 4090 and 5370. Clients which do not understand the encoding still distribute connections in
+roughly the same ratios. The encoding is only recognized if every target in a priority is encoded
+with the same algorithm. A Selector set with cslb.SetSelector() takes precedence over a signalled
+algorithm which takes precedence over Options.Selector.
+
+Cslb times every dial to a target and keeps an exponentially weighted moving average of the
+durations as the round trip time (RTT) of the target. If Options.HealthCheckRTT is set, the TCP
+connect time of successful http(s) health checks also contributes to the RTT. Only the connect is
+timed, so server processing and TLS handshakes don't skew the RTT, and no sample is taken when a
+health check re-uses an idle connection. When SRV targets span several regions, setting
+Options.PreferLowLatency biases the weights within a priority toward the lower latency targets: each
+weight is scaled by the ratio of the lowest RTT in the priority to the RTT of the target, so a
+target twice as far away as the nearest receives half its normal share. Targets which have not yet
+been measured keep their full weight so that they do get measured. The bias applies to the default
+RFC2782 selection and to any Selector which uses weights.
+
 # RULES OF INTERCEPTION
 
 Cslb has specific rules about when interception occurs. It normally only considers intercepting port
@@ -79,6 +155,12 @@ Cslb has specific rules about when interception occurs. It normally only conside
 non-standard HTTP ports and maps them to numeric service names. For example http://example.net:8080
 gets mapped to _8080._tcp.example.net as the SRV name to resolve.
 
+The mapping from port to service is a guess because the URL scheme is not visible to a Dial
+Request. Applications which wrap their transport with cslb.NewRoundTripper() avoid the guesswork as
+the RoundTripper passes the URL scheme down to cslb. For example https://example.net:8443 gets
+mapped to _https._tcp.example.net. An application can also nominate the service explicitly for any
+request by setting the request context with cslb.WithService().
+
 # ACTIVE HEALTH CHECKS
 
 While cslb runs passively by caching the results of previous Dial Requests, it can also run actively
@@ -93,6 +175,20 @@ the target. E.g. if the SRV target is "s1.example.net:80" then cslb looks for th
 no TXT RR exists or the contents do not form a valid URL then no active health check is performed
 for that target.
 
+When the built-in resolver is configured with "cslb_dns", a URI RR (RFC7553) at the same name is
+preferred over the TXT RR, e.g.:
+
+	_80._cslb.s1.example.net. IN URI 10 1 "http://s1.example.net/hc"
+
+If there are multiple URI RRs, one is chosen by priority and weight in the same way as SRV targets.
+The go resolver cannot look up URI RRs so only TXT RRs are used with it.
+
+Rather than publishing a TXT RR for every target, a single TXT RR at the "_cslb" sub-domain of the
+SRV name can be used as a template for all targets of the SRV which have no TXT RR of their own.
+The template is a text/template expanded with .Target, .Port, .Service and .SRVName, e.g.:
+
+	_cslb._https._tcp.example.net. IN TXT "https://{{.Target}}:{{.Port}}/healthz"
+
 The health check URL does not have to be related to the target in any particular way. It could be a
 URL to a central monitoring system which performs complicated application level tests and
 performance monitoring. Or it could be a URL on the target system itself.
@@ -102,6 +198,65 @@ contains the uppercase text "OK" somewhere in the body (See the "cslb_hc_ok" env
 for how this can be modified). Unless both those conditions are met the target is considered
 unavailable.
 
+Alternatively, if the health check response has a json Content-Type, the body is parsed as a json
+object with the following optional fields:
+
+	{"status": "ok", "utilization": 0.42, "weight": 80}
+
+The target is considered available if "status" is "ok". A "utilization" between 0 and 1 reduces the
+SRV weight of the target proportionally and "weight" scales the SRV weight as a percentage. Thus
+lightly loaded targets receive proportionally more new connections without any change to the SRV
+RRs. Biased weights only apply within the same SRV priority.
+
+To stop a flapping target from oscillating in and out of rotation, a target is only removed after
+"fall" consecutive failed health checks and only reinstated after "rise" consecutive successful
+health checks. These thresholds default to one and are set globally with the "cslb_hc_fall" and
+"cslb_hc_rise" environment variables.
+
+Rather than a bare URL, the TXT RR may contain white-space separated key=value settings which
+control the health check of that target, e.g.:
+
+	_80._cslb.s1.example.net. IN TXT "url=http://s1.example.net/hc method=HEAD expect=200-299 rise=2"
+
+The recognized settings are:
+
+	url=URL              - The health check URL. May be a bare URL if it is the first setting
+	method=GET           - The http request method
+	expect=200           - Comma separated list of acceptable status codes and ranges
+	body=OK              - strings.Contains in a non-json response body (default "cslb_hc_ok")
+	header=Name:Value    - Add a request header. May be repeated
+	timeout=10s          - Maximum duration of a single health check (default "cslb_hc_timeout")
+	interval=50s         - Time between health checks (default "cslb_hc_freq")
+	rise=1               - Consecutive successful checks before a target is reinstated
+	fall=1               - Consecutive failed checks before a target is removed
+
+Unlike the environment variables, timeout and interval may be sub-second with lower limits of 10ms
+and 100ms respectively. Unknown settings and invalid values are ignored. The body is not checked
+for HEAD requests unless body is set. At most 64KiB of a response body is read (see
+Options.HealthCheckMaxBody).
+
+Https and tls health checks verify the certificate of the health check endpoint against the system
+root CAs unless "cslb_hc_ca" names a PEM file of alternate root CAs. Endpoints which require mTLS
+are supported by setting "cslb_hc_cert" and "cslb_hc_key" to the PEM client certificate and key.
+Applications using cslb.New() can supply their own tls.Config with Options.HealthCheckTLSConfig.
+
+Health checks for non-HTTP services are selected by the scheme of the URL in the TXT RR. The
+built-in "tcp://host:port" check succeeds if a TCP connection can be established and the built-in
+"tls://host:port" check succeeds if a TLS handshake completes. Applications can register their own
+checks with cslb.RegisterHealthChecker(), e.g.:
+
+	cslb.RegisterHealthChecker("redis", cslb.HealthCheckerFunc(redisPing))
+
+which is then used for TXT RRs such as "redis://r1.example.net:6379". A HealthChecker registered
+under an SRV service name is also used for every target of that service which has no TXT RR, so the
+above registration checks all targets of _redis._tcp.example.net without any TXT RRs at all.
+
+All health checks are run by a single scheduler with a fixed pool of workers so that a large number
+of targets does not result in a large number of go-routines or a burst of simultaneous checks. At
+most "cslb_hc_workers" health checks run concurrently and the interval of each target is randomly
+varied by up to 10% so that targets do not remain synchronized. The scheduler stops with the cslb
+instance, e.g. when Balancer.Stop() is called.
+
 Active health checks cease once a target becomes idle for too long and health check Dial Requests
 are *not* get intercepted by cslb.
 
@@ -145,8 +300,25 @@ A number of observations about this DNS setup:
 
 Cslb maintains a cache of SRV lookups and the health status of targets. Cache entries automatically
 age out as a form of garbage collection. Removed cache entries stop any associated active health
-checks. Unfortunately the cache ageing does not have access to the DNS TTLs associated with the SRV
-RRs so it makes a best-guess at reasonable time-to-live values.
+checks. Unfortunately the go resolver does not provide access to the DNS TTLs associated with the SRV
+RRs so by default cslb makes a best-guess at reasonable time-to-live values.
+
+If the "cslb_dns" environment variable (or Options.DNSServers) is set to a comma separated list of
+recursive DNS servers, cslb uses its own built-in resolver which does return TTLs. In that case SRV
+and health check TXT RRs are cached for as long as the zone operator intended and negative responses
+are cached as defined by the SOA of the zone.
+
+So that busy services never wait on DNS, SRVs which have been used since they were last fetched are
+re-fetched shortly before they expire ("cslb_srv_refresh", default 5s) and the new results replace
+the cache entry in-place.
+
+A DNS lookup which fails with a timeout, SERVFAIL or similar transient error is only cached for a
+short time ("cslb_err_ttl", default 30s) and in the meantime any targets from the previous lookup
+continue to be used. Only a definitive NXDOMAIN or empty answer is cached as a not-found SRV.
+
+Similar to RFC8767, the targets of an expired SRV continue to be served, flagged as stale on the
+status page, while DNS lookups fail. This continues until DNS answers again or until the stale limit
+("cslb_stale", default 1h) past the original expiry is reached.
 
 The important point to note is that *all* values get periodically refreshed from the DNS. Nothing
 persists internally forever regardless of the level of activity. This means you can be sure that any
@@ -161,6 +333,10 @@ server. E.g.:
 
 	$ cslb_listen=127.0.0.1:8081 ./myProgram
 
+Connections to SRV targets are tracked from the time they are returned until they are closed so
+the status page shows the open connections, bytes read and written and average connection lifetime
+of each target.
+
 # RUN TIME CONTROLS
 
 On initialization the cslb package examines the "cslb_options" environment variable for single
@@ -173,8 +349,11 @@ letter options which have the following meaning:
 	's' - Debug print SRV Lookups
 
 	'C' - Disable all Dial Request interception
+	'D' - Do not Enable http.DefaultTransport at package initialization
 	'H' - Disable all health checks
+	'L' - Bias weights toward low latency targets (PreferLowLatency)
 	'N' - Allow numeric service lookups for non-HTTP(S) ports
+	'R' - Include health check connect times in target RTTs (HealthCheckRTT)
 
 An example of how this might by used from a shell:
 
@@ -183,19 +362,32 @@ An example of how this might by used from a shell:
 Many internal configuration values can be over-ridden with environment variables as shown in this
 table:
 
-	+----------------+----------------------------------------+---------+---------------+
-	| Variable Name  | Description                            | Default | Format        |
-	+----------------+----------------------------------------+---------+---------------+
-	| cslb_dial_veto | Target veto period after dial fails    | 1m      | time.Duration |
-	| cslb_hc_freq   | Frequency of health checks per target  | 50s     | time.Duration |
-	| cslb_hc_ok     | strings.Contains in health check body  | "OK"    | String        |
-	| cslb_listen    | Listen address for status server       |         | address:port  |
-	| cslb_nxd_ttl   | Cache lifetime for NXDOMAIN SRVs       | 20m     | time.Duration |
-	| cslb_srv_ttl   | Cache lifetime for found SRVs          | 5m      | time.Duration |
-	| cslb_tar_ttl   | Cache lifetime for dial Targets        | 5m      | time.Duration |
-	| cslb_templates | Alternate status server html/templates |         | filepath.Glob |
-	| cslb_timeout   | Default intercept Dial duration        | 1m      | time.Duration |
-	+----------------+----------------------------------------+---------+---------------+
+	+------------------+----------------------------------------+---------+---------------+
+	| Variable Name    | Description                            | Default | Format        |
+	+------------------+----------------------------------------+---------+---------------+
+	| cslb_dial_veto   | Minimum target veto after dial fails   | 1m      | time.Duration |
+	| cslb_dns         | Servers for the built-in DNS resolver  |         | host[:port],..|
+	| cslb_err_ttl     | Cache lifetime for failed SRV lookups  | 30s     | time.Duration |
+	| cslb_hc_freq     | Frequency of health checks per target  | 50s     | time.Duration |
+	| cslb_hc_ca       | PEM root CAs for https/tls checks      |         | File path     |
+	| cslb_hc_cert     | PEM client cert for https/tls checks   |         | File path     |
+	| cslb_hc_fall     | Consecutive failed checks to remove    | 1       | Integer       |
+	| cslb_hc_key      | PEM client key for https/tls checks    |         | File path     |
+	| cslb_hc_ok       | strings.Contains in health check body  | "OK"    | String        |
+	| cslb_hc_rise     | Consecutive good checks to reinstate   | 1       | Integer       |
+	| cslb_hc_timeout  | Maximum duration of a health check     | 10s     | time.Duration |
+	| cslb_hc_workers  | Maximum concurrent health checks       | 8       | Integer       |
+	| cslb_listen      | Listen address for status server       |         | address:port  |
+	| cslb_nxd_ttl     | Cache lifetime for NXDOMAIN SRVs       | 20m     | time.Duration |
+	| cslb_selector    | Target selection algorithm             | random  | Selector name |
+	| cslb_stale       | Serve stale SRV targets for this long  | 1h      | time.Duration |
+	| cslb_srv_refresh | Re-fetch active SRVs before expiry     | 5s      | time.Duration |
+	| cslb_srv_ttl     | Cache lifetime for found SRVs          | 5m      | time.Duration |
+	| cslb_tar_ttl     | Cache lifetime for dial Targets        | 5m      | time.Duration |
+	| cslb_templates   | Alternate status server html/templates |         | filepath.Glob |
+	| cslb_timeout     | Default intercept Dial duration        | 1m      | time.Duration |
+	| cslb_veto_max    | Maximum target veto after dial fails   | 10m     | time.Duration |
+	+------------------+----------------------------------------+---------+---------------+
 
 Any values which are invalid or fall outside a reasonable range are ignored.
 
@@ -245,6 +437,15 @@ otherwise those http requests will not be intercepted. Of course if the package
 incidental to the core functionality of your application then maybe it doesn't matter and you can
 leave them be. Something to be aware of.
 
+Connections to SRV targets are returned wrapped so that cslb can track them. Applications which
+type assert the returned net.Conn, e.g. to a *net.TCPConn, will find that the assertion fails. The
+wrapper forwards CloseWrite, io.ReaderFrom and io.WriterTo to the underlying connection and, as
+with tls.Conn, the underlying connection is available from its NetConn() method, e.g.:
+
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		tcp, _ := nc.NetConn().(*net.TCPConn)
+	}
+
 -----
 */
 package cslb
@@ -2,16 +2,83 @@ package cslb
 
 import (
 	"net/http"
+	"sync"
+	"weak"
 )
 
+// enabled records the transports which have been enabled along with the DialContext which was in
+// place prior to Enable. This is how Enable and Disable know whether a transport is intercepted
+// without ever calling its DialContext, which may well be a foreign dialer with side-effects.
+//
+// The registry is keyed by a weak pointer so that an enabled transport which is dropped by the
+// application can still be garbage collected without first being Disabled. Entries for collected
+// transports are swept on each Enable.
+//
+// enabledMu protects enabled and serializes Enable and Disable as they read then replace
+// http.Transport.DialContext.
+var (
+	enabledMu sync.Mutex
+	enabled   = make(map[weak.Pointer[http.Transport]]dialContextFunc)
+)
+
+// originalDialContext returns the DialContext which was in place prior to Enable and true if the
+// transport is currently enabled by any cslb instance. The caller must hold enabledMu.
+func originalDialContext(ht *http.Transport) (dialContextFunc, bool) {
+	orig, ok := enabled[weak.Make(ht)]
+
+	return orig, ok
+}
+
 // Enable activates cslb processing for the http.Transport. The same transport is returned as a
 // convenience to the caller so they can make the Enable function part of a wrapper chain, thus:
 //
 //	client := &http.Client{Transport: cslb.Enable(&http.Transport{})}
 //
-// The Enable function replaces the http.Transport.DialContent with cslb's dialContext.
+// The Enable function replaces the http.Transport.DialContent with cslb's dialContext. The
+// DialContext which was in place prior to Enable is retained and used by cslb to make the actual
+// connections to the SRV targets, so any custom dialer settings such as source address binding,
+// socket options or proxying continue to apply. If the transport had no DialContext, cslb uses a
+// net.Dialer configured the same way as net/http configures its default dialer. Calling Enable on
+// an already enabled transport is harmless.
 func Enable(ht *http.Transport) *http.Transport {
-	ht.DialContext = getCSLB().dialContext
+	return getCSLB().enable(ht)
+}
+
+// Disable reverses the effect of Enable by restoring the http.Transport.DialContext which was in
+// place prior to Enable being called. Calling Disable on a transport which was never enabled has no
+// effect. As with Enable, the same transport is returned as a convenience to the caller.
+//
+// Disable only affects new connections. Any connections previously established by cslb and cached
+// by the transport continue to be used until the transport closes them.
+func Disable(ht *http.Transport) *http.Transport {
+	enabledMu.Lock()
+	defer enabledMu.Unlock()
+
+	if orig, ok := originalDialContext(ht); ok {
+		ht.DialContext = orig
+		delete(enabled, weak.Make(ht))
+	}
+
+	return ht
+}
+
+// enable is the common implementation for Enable() and Balancer.Enable().
+func (t *cslb) enable(ht *http.Transport) *http.Transport {
+	enabledMu.Lock()
+	defer enabledMu.Unlock()
+
+	for wp := range enabled { // Sweep transports which have been collected
+		if wp.Value() == nil {
+			delete(enabled, wp)
+		}
+	}
+
+	orig, ok := originalDialContext(ht)
+	if !ok { // Only remember the original DialContext
+		orig = ht.DialContext
+		enabled[weak.Make(ht)] = orig
+	}
+	ht.DialContext = t.chainDialContext(orig)
 
 	return ht
 }
@@ -0,0 +1,138 @@
+package cslb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+	"weak"
+)
+
+// enabledOrig is originalDialContext with the lock held.
+func enabledOrig(ht *http.Transport) (dialContextFunc, bool) {
+	enabledMu.Lock()
+	defer enabledMu.Unlock()
+
+	return originalDialContext(ht)
+}
+
+// Test that Disable restores the original DialContext and that a double Enable does not lose it.
+func TestEnableDisable(t *testing.T) {
+	realInit()
+	origCalled := false
+	orig := func(ctx context.Context, network, address string) (net.Conn, error) {
+		origCalled = true
+		return nil, fmt.Errorf("orig dialer")
+	}
+	ht := &http.Transport{DialContext: orig}
+	Enable(ht)
+	Enable(ht) // Second Enable must not remember cslb as the original
+	if origCalled {
+		t.Error("Enable should not call the original DialContext")
+	}
+	Disable(ht)
+	if origCalled {
+		t.Error("Disable should not call the original DialContext")
+	}
+	ht.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	if !origCalled {
+		t.Error("Disable did not restore the original DialContext")
+	}
+
+	if _, ok := enabledOrig(ht); ok {
+		t.Error("Disable did not forget the transport")
+	}
+
+	Disable(ht) // Disabling a non-enabled transport should be harmless
+	origCalled = false
+	ht.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	if !origCalled {
+		t.Error("Second Disable clobbered the original DialContext")
+	}
+}
+
+// Test that the 'D' option stops init from enabling the http.DefaultTransport.
+func TestEnableDisableDefaultTransport(t *testing.T) {
+	dt := http.DefaultTransport.(*http.Transport)
+	Disable(dt)
+	t.Setenv(cslbEnvPrefix+"options", "D")
+	realInit()
+	if _, ok := enabledOrig(dt); ok {
+		t.Error("DefaultTransport should not have been enabled with the 'D' option")
+	}
+
+	unsetAll()
+	realInit() // Restore normal state for subsequent tests
+	if _, ok := enabledOrig(dt); !ok {
+		t.Error("DefaultTransport should have been enabled without the 'D' option")
+	}
+}
+
+// Test that Enable chains to the transport's existing DialContext for both SRV targets and
+// pass-thru addresses rather than using the cslb system dialer.
+func TestEnableChainsDialContext(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	mr.appendSRV("http", "tcp", "example.net", "realtarget", 8080, 1, 1)
+	cslb.netResolver = mr
+	system := newMockDialer()
+	cslb.systemDialContext = system.dialContext
+
+	custom := newMockDialer()
+	ht := Enable(&http.Transport{DialContext: custom.dialContext})
+	defer Disable(ht)
+
+	ht.DialContext(context.Background(), "tcp", "example.net:80")
+	if custom.address() != "realtarget:8080" {
+		t.Error("SRV target should have been dialed by the chained dialer, not", custom.address())
+	}
+
+	ht.DialContext(context.Background(), "tcp", "127.0.0.1:80")
+	if custom.address() != "127.0.0.1:80" {
+		t.Error("Pass-thru should have been dialed by the chained dialer, not", custom.address())
+	}
+	if len(system.addressList()) != 0 {
+		t.Error("System dialer should not have been called", system.addressList())
+	}
+}
+
+// Test that an enabled transport which is no longer referenced can be garbage collected.
+func TestEnableNoLeak(t *testing.T) {
+	realInit()
+	collected := make(chan struct{})
+	func() {
+		ht := Enable(&http.Transport{})
+		runtime.SetFinalizer(ht, func(*http.Transport) { close(collected) })
+	}()
+	for ix := 0; ix < 20; ix++ {
+		runtime.GC()
+		select {
+		case <-collected:
+			return
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	t.Error("Enabled transport was never collected")
+}
+
+// Test that the registry does not retain entries for collected transports.
+func TestEnableSweep(t *testing.T) {
+	realInit()
+	wp := weak.Make(Enable(&http.Transport{}))
+	for ix := 0; ix < 20 && wp.Value() != nil; ix++ {
+		runtime.GC()
+	}
+	if wp.Value() != nil {
+		t.Fatal("Enabled transport was never collected")
+	}
+	ht := Enable(&http.Transport{})
+	defer Disable(ht)
+	enabledMu.Lock()
+	defer enabledMu.Unlock()
+	if _, ok := enabled[wp]; ok {
+		t.Error("Expected collected transport to be swept from the registry")
+	}
+}
@@ -24,8 +24,9 @@ var (
 	currentCSLB *cslb        // be sure they are working with a known initial state.
 )
 
-// init enables the http DefaultTransport for CSLB processing. Perhaps we should have an env
-// variable to control this or possibly not even enable it by default?
+// init enables the http DefaultTransport for CSLB processing unless the "D" option is present in
+// the "cslb_options" environment variable, in which case nothing is intercepted until the
+// application explicitly calls Enable().
 func init() {
 	realInit().start()
 }
@@ -34,7 +35,9 @@ func init() {
 // innards of what is needed to reset the globals to their initial state.
 func realInit() *cslb {
 	cslb := setCSLB(newCslb())
-	Enable(http.DefaultTransport.(*http.Transport))
+	if !cslb.DisableDefaultTransport {
+		Enable(http.DefaultTransport.(*http.Transport))
+	}
 
 	return cslb
 }
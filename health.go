@@ -20,33 +20,51 @@ encapsulation.
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
 type healthCache struct {
-	sync.RWMutex                      // Protects everything within this struct
-	done         chan bool            // Shuts down the cache cleaner
-	cache        map[string]*ceHealth // The key is ToLower(target:port) - use makeHealthStoreKey()
+	sync.RWMutex                       // Protects everything within this struct
+	done         chan bool             // Shuts down the cache cleaner
+	cache        map[string]*ceHealth  // The key is ToLower(target:port) - use makeHealthStoreKey()
+	retired      map[string]*connStats // connStats of expired entries with open connections
 }
 
 type ceHealth struct {
 	expires               time.Time // When this entry expire out of the cache
 	goodDials             int
 	failedDials           int
+	dialFailures          int       // Consecutive failed dials - drives the veto backoff
 	nextDialAttempt       time.Time // When we can next consider this target - IsZero() means now
 	lastDialAttempt       time.Time
 	lastDialStatus        string
 	lastHealthCheck       time.Time
-	lastHealthCheckStatus string // From http.Get()
-	url                   string // URL to probe to confirm target is healthy
-	unHealthy             bool   // True if last health check failed
+	lastHealthCheckStatus string        // From http.Get()
+	url                   string        // URL to probe to confirm target is healthy
+	unHealthy             bool          // True if last health check failed
+	weightBias            float64       // Multiplier of SRV weight from health check - zero means none
+	srvName               string        // SRV qName which created this entry, if known
+	hcFailures            int           // Consecutive failed health checks
+	hcSuccesses           int           // Consecutive successful health checks
+	rise, fall            int           // Thresholds in effect for this target - for reporting purposes
+	dialing               int           // Dials currently in progress - see beginDial()
+	rtt                   time.Duration // EWMA of dial (and optionally health check) durations
+	conns                 *connStats    // Connections returned to the application - see conn.go
 }
 
 // isGood returns whether a target can be used. Caller must have locked beforehand.
@@ -70,7 +88,8 @@ func unpackHealthStoreKey(targetKey string) (host, port string) {
 }
 
 func newHealthCache() *healthCache {
-	return &healthCache{cache: make(map[string]*ceHealth), done: make(chan bool)}
+	return &healthCache{cache: make(map[string]*ceHealth), retired: make(map[string]*connStats),
+		done: make(chan bool)}
 }
 
 func (t *healthCache) start(cacheInterval time.Duration) {
@@ -83,18 +102,20 @@ func (t *healthCache) stop() {
 
 // populateHealthStore adds a list of targets to the healthStore. Supplied keys are fully formed
 // cache keys, that is, target:port. It also starts off the health check for each new target if HC
-// is enabled.
-func (t *cslb) populateHealthStore(now time.Time, healthStoreKeys []string) {
+// is enabled. The srvName is the SRV qName of the targets and is used to find service-level health
+// checks if the target has no health check TXT RR.
+func (t *cslb) populateHealthStore(now time.Time, srvName string, healthStoreKeys []string) {
 	t.healthStore.Lock()
 	defer t.healthStore.Unlock()
 
 	for _, healthStoreKey := range healthStoreKeys {
 		ceh := t.healthStore.cache[healthStoreKey]
 		if ceh == nil {
-			ceh = &ceHealth{expires: now.Add(t.HealthTTL)}
+			ceh = &ceHealth{expires: now.Add(t.HealthTTL), srvName: srvName,
+				conns: t.healthStore.adoptConnStats(healthStoreKey)}
 			t.healthStore.cache[healthStoreKey] = ceh
 			if !t.DisableHealthChecks {
-				go t.fetchAndRunHealthCheck(healthStoreKey, ceh)
+				t.scheduleHealthCheck(now, healthStoreKey, ceh)
 			}
 		}
 	}
@@ -113,92 +134,663 @@ func (t *cslb) setDialResult(now time.Time, host string, port int, err error) {
 	healthStoreKey := makeHealthStoreKey(host, port)
 	ceh := t.healthStore.cache[healthStoreKey]
 	if ceh == nil { // I would expect an entry to be here
-		ceh = &ceHealth{expires: now.Add(t.HealthTTL)}
+		ceh = &ceHealth{expires: now.Add(t.HealthTTL), conns: t.healthStore.adoptConnStats(healthStoreKey)}
 		t.healthStore.cache[healthStoreKey] = ceh
 		if !t.DisableHealthChecks {
-			go t.fetchAndRunHealthCheck(healthStoreKey, ceh)
+			t.scheduleHealthCheck(now, healthStoreKey, ceh)
 		}
 	}
 	ceh.lastDialAttempt = now
 	if err == nil {
 		ceh.goodDials++
+		ceh.dialFailures = 0
 		ceh.nextDialAttempt = zeroTime
 		ceh.lastDialStatus = ""
 	} else {
 		ceh.failedDials++
-		ceh.nextDialAttempt = now.Add(t.DialVetoDuration)
+		ceh.dialFailures++
+		ceh.nextDialAttempt = now.Add(t.dialVeto(ceh.dialFailures))
 		ceh.lastDialStatus = err.Error()
 	}
 }
 
-// fetchAndRunHealthCheck is normally started as a separate go-routine when a target is added to the
-// healthStore. It fetches the health check URL and if present runs a periodic GET check until the
-// ceHealth entry expires. The health check URL is stored in a TXT RR. It could be a TypeURI RR
-// (RFC7553) I suppose, but who supports/uses those? The qName for the TXT RR is of the form
-// _$port._cslb.$target, thus something like _80._cslb.example.net where port is from the SRV RR.
-func (t *cslb) fetchAndRunHealthCheck(healthStoreKey string, ceh *ceHealth) {
+// dialVeto returns how long a target is vetoed after consecutive dial failures. It starts at
+// DialVetoDuration and doubles with each failure up to DialVetoMaxDuration so that a dead target is
+// only tried occasionally. Jitter stops the clients of a dead target from all retrying it at the
+// same moment but is itself clamped so the veto never strays outside the configured durations.
+func (t *cslb) dialVeto(failures int) time.Duration {
+	veto := jitter(backoff(failures, t.DialVetoDuration, t.DialVetoMaxDuration))
+	if veto < t.DialVetoDuration {
+		veto = t.DialVetoDuration
+	}
+	if veto > t.DialVetoMaxDuration {
+		veto = t.DialVetoMaxDuration
+	}
+
+	return veto
+}
+
+// beginDial notes that a dial to the target is in progress so that Selectors can see how many
+// connections are outstanding. It must be followed by endDial once the dial completes.
+func (t *cslb) beginDial(host string, port int) {
+	t.healthStore.Lock()
+	defer t.healthStore.Unlock()
+
+	ceh := t.healthStore.cache[makeHealthStoreKey(host, port)]
+	if ceh != nil {
+		ceh.dialing++
+	}
+}
+
+// endDial is the counterpart of beginDial. The latency of a successful dial is added to the RTT of
+// the target. Called after setDialResult so the ceHealth is known to exist.
+func (t *cslb) endDial(host string, port int, latency time.Duration, err error) {
+	t.healthStore.Lock()
+	defer t.healthStore.Unlock()
+
+	ceh := t.healthStore.cache[makeHealthStoreKey(host, port)]
+	if ceh == nil {
+		return
+	}
+	if ceh.dialing > 0 { // Could be zero if the entry was replaced during the dial
+		ceh.dialing--
+	}
+	if err == nil {
+		ceh.addRTTSample(latency)
+	}
+}
+
+// rttSampleWeight is the weight given to each new sample by the RTT EWMA. Smaller values smooth
+// out jitter at the cost of reacting more slowly to a genuine change in latency.
+const rttSampleWeight = 0.25
+
+// addRTTSample folds the sample into the EWMA RTT. The first sample is taken as is. Caller must
+// hold the healthStore lock.
+func (t *ceHealth) addRTTSample(sample time.Duration) {
+	if t.rtt == 0 {
+		t.rtt = sample
+		return
+	}
+	t.rtt = time.Duration(float64(t.rtt)*(1-rttSampleWeight) + float64(sample)*rttSampleWeight)
+	if t.rtt == 0 { // Zero means unknown so never go back to it
+		t.rtt = 1
+	}
+}
+
+// scheduleHealthCheck creates the health check task for a new target and hands it to the
+// scheduler. The task first runs immediately to fetch the health check URL. Caller must hold the
+// healthStore lock, which is fine, as the scheduler doesn't touch the healthStore.
+func (t *cslb) scheduleHealthCheck(now time.Time, healthStoreKey string, ceh *ceHealth) {
+	t.hcScheduler.schedule(&hcTask{key: healthStoreKey, ceh: ceh, next: now})
+}
+
+// runHealthCheck is called by a scheduler worker each time the target's task is due. The first run
+// fetches the health check URL and, if present, each subsequent run performs one check until the
+// ceHealth entry expires. The health check URL is stored in a URI RR (RFC7553) or a TXT RR. The
+// qName for either RR is of the form _$port._cslb.$target, thus something like
+// _80._cslb.example.net where port is from the SRV RR.
+//
+// A failed check, including a transport error, marks the target unhealthy but the checks continue
+// so that the target is reinstated as soon as a check succeeds. Transport errors are retried sooner
+// than normal with an exponential backoff.
+//
+// Similarly, if the first fetch of the health check URL fails for any reason other than the RR not
+// existing, such as a DNS timeout, the fetch is retried with the same backoff. The task is only
+// dropped if the DNS says there is no health check or once the ceHealth entry expires.
+//
+// If the resolver returns TTLs the TXT RR is re-fetched whenever its TTL expires so that changes to
+// the health check URL are noticed while the target is active.
+//
+// Returns true if the task is to be re-scheduled at task.next.
+func (t *cslb) runHealthCheck(ctx context.Context, task *hcTask) bool {
+	now := time.Now()
+	ls := &cslbStats{}
+	defer t.addStats(ls)
+	if now.Sub(task.next) > time.Second {
+		ls.LateChecks++
+	}
+
+	t.healthStore.RLock()
+	expires := task.ceh.expires // Extract under protection of the lock
+	t.healthStore.RUnlock()
+	if expires.Before(now) {
+		return false
+	}
+
+	if task.spec == nil { // First run?
+		spec, urlExpires, err := t.fetchHealthCheckSpec(ctx, task.key, task.ceh)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if ctx.Err() != nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) { // No health check
+				return false
+			}
+			task.fetchFailures++ // Otherwise assume it's transient and try again later
+			task.next = now.Add(jitter(healthCheckBackoff(task.fetchFailures, t.HealthCheckFrequency)))
+			return true
+		}
+		task.spec, task.urlExpires = spec, urlExpires
+		task.next = now.Add(jitter(time.Second)) // Only wait a short time for the first health check
+		return true
+	}
+
+	if !task.urlExpires.IsZero() && task.urlExpires.Before(now) { // Is it time to re-fetch the TXT?
+		spec, urlExpires, err := t.fetchHealthCheckSpec(ctx, task.key, task.ceh)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound { // Health check has been removed
+				t.healthStore.Lock()
+				task.ceh.unHealthy = false
+				task.ceh.url = ""
+				t.healthStore.Unlock()
+				return false
+			}
+			spec = task.spec // Otherwise keep using the current spec and try again later
+			urlExpires = now.Add(task.spec.interval)
+		}
+		task.spec, task.urlExpires = spec, urlExpires
+	}
+
+	ls.HealthChecks++
+	spec := task.spec
+	probeCtx, connectTime := ctx, time.Duration(0)
+	if t.HealthCheckRTT {
+		probeCtx = withConnectTimer(ctx, &connectTime)
+	}
+	ok, bias, status, err := t.probe(probeCtx, spec)
+	if ctx.Err() != nil { // Scheduler is stopping so the result is meaningless
+		return false
+	}
+	if err == nil && ok && connectTime > 0 { // Only a healthy target reflects normal latency
+		t.healthStore.Lock()
+		task.ceh.addRTTSample(connectTime)
+		t.healthStore.Unlock()
+	}
+	if err == nil {
+		if t.PrintHCResults {
+			fmt.Println("Health Check Set:", task.key, ok, bias)
+		}
+		t.setHealthCheckResult(task.ceh, spec, now, ok, bias, status)
+		task.next = now.Add(jitter(spec.interval))
+		return true
+	}
+
+	// Transport errors are most likely due to the target restarting or being otherwise
+	// temporarily unreachable so retry sooner than normal, backing off exponentially until the
+	// normal frequency is reached.
+
+	if t.PrintHCResults {
+		fmt.Println("Health Check:", task.key, err)
+	}
+	failures := t.setHealthCheckResult(task.ceh, spec, now, false, 0, err.Error())
+	task.next = now.Add(jitter(healthCheckBackoff(failures, spec.interval)))
+
+	return true
+}
+
+// withConnectTimer returns a context which records the duration of the first successful connection
+// set up by an http request made with it. Only the TCP connect is timed so that the sample is
+// comparable with the dial samples which make up the rest of the RTT; server processing and TLS
+// handshakes would otherwise favour targets with cheaper health check endpoints. No sample is
+// recorded if the request re-uses an idle connection or if the health check isn't http(s).
+func withConnectTimer(ctx context.Context, connectTime *time.Duration) context.Context {
+	var mu sync.Mutex // Happy eyeballs may make concurrent connection attempts
+	starts := make(map[string]time.Time)
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			starts[network+addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if start, ok := starts[network+addr]; ok && err == nil && *connectTime == 0 {
+				*connectTime = time.Since(start)
+			}
+		},
+	})
+}
+
+// probe runs a single health check as defined by the spec. Http and https URLs are requested with
+// the health check client and evaluated by evalHealthCheck. Other URLs are passed to the
+// HealthChecker registered for the scheme and are healthy if the HealthChecker returns nil. An error
+// is only returned if the http request fails at the transport level as all HealthChecker errors
+// are treated as transport errors.
+func (t *cslb) probe(ctx context.Context, spec *hcSpec) (ok bool, bias float64, status string, err error) {
+	u, err := url.Parse(spec.url)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, spec.timeout)
+	defer cancel()
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		hc := t.healthChecker(u.Scheme)
+		if hc == nil {
+			return false, 0, "", fmt.Errorf("cslb: No HealthChecker for %s", spec.url)
+		}
+		err = hc.Check(ctx, u)
+		if err != nil {
+			return
+		}
+
+		return true, 0, "OK", nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, spec.method, spec.url, nil)
+	if err != nil {
+		return
+	}
+	for name, values := range spec.headers {
+		req.Header[name] = values
+	}
+	if host := spec.headers.Get("Host"); len(host) > 0 { // net/http ignores a Host header
+		req.Host = host
+	}
+	resp, err := t.hcClient.Do(req)
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, t.HealthCheckMaxBody)) // Anything more is ignored
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	ok, bias = evalHealthCheck(spec, resp, body)
+
+	return ok, bias, resp.Status, nil
+}
+
+// setHealthCheckResult records the outcome of a health check in the ceHealth and returns the
+// number of consecutive failed health checks. The target only transitions to unhealthy after
+// spec.fall consecutive failures and only transitions back to healthy after spec.rise consecutive
+// successes so that a flapping target doesn't oscillate in and out of rotation.
+func (t *cslb) setHealthCheckResult(ceh *ceHealth, spec *hcSpec, now time.Time, ok bool, bias float64,
+	status string) int {
+	t.healthStore.Lock()
+	defer t.healthStore.Unlock()
+
+	ceh.lastHealthCheck = now
+	ceh.lastHealthCheckStatus = status
+	ceh.rise = spec.rise
+	ceh.fall = spec.fall
+	if ok {
+		ceh.weightBias = bias
+		ceh.hcFailures = 0
+		ceh.hcSuccesses++
+		if ceh.unHealthy && ceh.hcSuccesses >= spec.rise {
+			ceh.unHealthy = false
+		}
+	} else {
+		ceh.hcSuccesses = 0
+		ceh.hcFailures++
+		if !ceh.unHealthy && ceh.hcFailures >= spec.fall {
+			ceh.unHealthy = true
+		}
+	}
+
+	return ceh.hcFailures
+}
+
+// healthCheckBackoff returns the delay before the next health check after consecutive transport
+// failures. It starts at one second and doubles with each failure up to the normal frequency.
+func healthCheckBackoff(failures int, frequency time.Duration) time.Duration {
+	return backoff(failures, time.Second, frequency)
+}
+
+// backoff returns min doubled for each failure after the first, capped at max.
+func backoff(failures int, min, max time.Duration) time.Duration {
+	delay := min
+	for ix := 1; ix < failures && delay < max; ix++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	return delay
+}
+
+// hcResponse is the structured health check response. All fields are optional. Status must be "ok"
+// (in any case) for the target to be considered healthy. Utilization is a fraction between 0 and 1
+// and Weight is a percentage of the SRV weight. Both bias the weight of the target in bestTarget().
+type hcResponse struct {
+	Status      string   `json:"status"`
+	Utilization *float64 `json:"utilization"`
+	Weight      *float64 `json:"weight"`
+}
+
+const (
+	maxHealthCheckWeight = 1000 // Upper limit of a health check weight percentage
+)
+
+// evalHealthCheck determines whether the health check response is good and the weight bias the
+// target should receive. A response with a json Content-Type is parsed as an hcResponse, otherwise
+// the body must contain spec.body. In either case the status code must be one of those expected by
+// the spec.
+//
+// The returned bias is a multiplier of the SRV weight. Zero means no bias. A non-zero bias is
+// never less than 1/smallChanceMultiplier so an overloaded target retains a "very small chance" of
+// selection in the same way that a zero weighted SRV does.
+func evalHealthCheck(spec *hcSpec, resp *http.Response, body []byte) (ok bool, bias float64) {
+	if !spec.expects(resp.StatusCode) {
+		return false, 0
+	}
+	if !strings.Contains(strings.ToLower(resp.Header.Get("Content-Type")), "json") {
+		return bytes.Contains(body, []byte(spec.body)), 0
+	}
+
+	var hcr hcResponse
+	if err := json.Unmarshal(body, &hcr); err != nil {
+		return false, 0
+	}
+	if !strings.EqualFold(hcr.Status, "ok") {
+		return false, 0
+	}
+	if hcr.Utilization == nil && hcr.Weight == nil {
+		return true, 0
+	}
+
+	bias = 1.0
+	if hcr.Utilization != nil {
+		bias *= 1.0 - math.Min(math.Max(*hcr.Utilization, 0), 1)
+	}
+	if hcr.Weight != nil {
+		bias *= math.Min(math.Max(*hcr.Weight, 0), maxHealthCheckWeight) / 100
+	}
+	if bias < 1.0/smallChanceMultiplier {
+		bias = 1.0 / smallChanceMultiplier
+	}
+
+	return true, bias
+}
+
+// effectiveWeight returns the weight of the target after applying any health check bias. Caller
+// must have locked beforehand.
+func (t *ceHealth) effectiveWeight(weight int) int {
+	if t == nil || t.weightBias == 0 {
+		return weight
+	}
+	weight = int(float64(weight) * t.weightBias)
+	if weight == 0 {
+		weight = 1
+	}
+
+	return weight
+}
+
+// hcSpec is the health check specification for a target as parsed from its TXT RR
+type hcSpec struct {
+	url      string
+	method   string        // Only relevant to http and https URLs as are all the following
+	expect   []statusRange // Acceptable response status codes
+	body     string        // Must be contained in non-json response body
+	headers  http.Header   // Added to the request
+	timeout  time.Duration // Maximum duration of a single check - applies to all URLs
+	interval time.Duration // Time between checks - applies to all URLs
+	rise     int           // Consecutive successes needed to transition to healthy
+	fall     int           // Consecutive failures needed to transition to unhealthy
+}
+
+type statusRange struct {
+	low, high int
+}
+
+// expects returns true if the status code is acceptable to the spec
+func (t *hcSpec) expects(code int) bool {
+	for _, sr := range t.expect {
+		if code >= sr.low && code <= sr.high {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHealthCheckSpec parses the TXT RR contents into an hcSpec. The TXT RR contains white-space
+// separated key=value settings which over-ride the global config for this target, e.g.
+//
+//	url=https://s1.example.net/hc method=HEAD expect=200-299,304 header=X-Probe:1 timeout=2s
+//
+// For backwards compatibility, the first setting may be a bare URL. Recognized keys are: url,
+// method, expect, body, header, timeout, interval, rise and fall. Header may be repeated. Unknown
+// keys and invalid values are ignored.
+func (t *cslb) parseHealthCheckSpec(txt string) *hcSpec {
+	spec := &hcSpec{method: http.MethodGet, expect: []statusRange{{http.StatusOK, http.StatusOK}},
+		headers: make(http.Header), timeout: t.HealthCheckTimeout, interval: t.HealthCheckFrequency,
+		rise: t.HealthCheckRise, fall: t.HealthCheckFall}
+	haveBody := false
+	fields := strings.FieldsFunc(txt, func(r rune) bool { return r == ' ' || r == '\t' })
+	for ix, field := range fields {
+		eq := strings.IndexByte(field, '=')
+		key := ""
+		if eq > 0 {
+			key = strings.ToLower(field[:eq])
+		}
+		if ix == 0 && strings.Contains(field, "://") && key != "url" { // A bare URL?
+			spec.url = field
+			continue
+		}
+		value := field[eq+1:]
+		switch key {
+		case "url":
+			spec.url = value
+		case "method":
+			if len(value) > 0 {
+				spec.method = strings.ToUpper(value)
+			}
+		case "expect":
+			if expect := parseStatusRanges(value); len(expect) > 0 {
+				spec.expect = expect
+			}
+		case "body":
+			spec.body = value
+			haveBody = true
+		case "header":
+			colon := strings.IndexByte(value, ':')
+			if colon > 0 {
+				spec.headers.Add(value[:colon], value[colon+1:])
+			}
+		case "timeout":
+			spec.timeout = parseLimitedDuration(value, spec.timeout,
+				lowerSpecTimeoutLimit, upperSpecLimit)
+		case "interval":
+			spec.interval = parseLimitedDuration(value, spec.interval,
+				lowerSpecIntervalLimit, upperSpecLimit)
+		case "rise":
+			spec.rise = parseThreshold(value, spec.rise)
+		case "fall":
+			spec.fall = parseThreshold(value, spec.fall)
+		}
+	}
+	if !haveBody && spec.method != http.MethodHead { // HEAD responses have no body to check
+		spec.body = t.HealthCheckContentOk
+	}
+
+	return spec
+}
+
+// parseStatusRanges parses a comma separated list of status codes and status code ranges such as
+// "200,204" or "200-299". Returns nil if any part is invalid.
+func parseStatusRanges(s string) (ranges []statusRange) {
+	for _, part := range strings.Split(s, ",") {
+		lowStr, highStr := part, part
+		if dash := strings.IndexByte(part, '-'); dash > 0 {
+			lowStr, highStr = part[:dash], part[dash+1:]
+		}
+		low, err1 := strconv.Atoi(lowStr)
+		high, err2 := strconv.Atoi(highStr)
+		if err1 != nil || err2 != nil || low < 100 || high > 599 || low > high {
+			return nil
+		}
+		ranges = append(ranges, statusRange{low, high})
+	}
+
+	return
+}
+
+// fetchHealthCheckSpec looks up the TXT RR containing the health check URL for the target and
+// records the URL in the ceHealth for reporting purposes. If the resolver returns TTLs, urlExpires
+// is set to when the TXT should be re-fetched, otherwise it IsZero().
+//
+// If the resolver supports URI RRs, a URI RR at the same qName takes precedence over the TXT RR.
+//
+// If there is no TXT RR for the target, a service-level TXT RR is looked up at _cslb.$srvName,
+// e.g. _cslb._https._tcp.example.net. It contains a text/template which is expanded with
+// hcTemplateData for the target, thus a single TXT RR such as
+// "https://{{.Target}}:{{.Port}}/healthz" serves every target of the SRV.
+//
+// If neither TXT RR exists but a HealthChecker is registered for the service of the target, a URL
+// of the form $service://$target:$port is synthesized for that HealthChecker.
+//
+// All lookups are abandoned if ctx is cancelled so that a stopping scheduler isn't held up by
+// unresponsive DNS servers.
+func (t *cslb) fetchHealthCheckSpec(ctx context.Context, healthStoreKey string, ceh *ceHealth) (spec *hcSpec, urlExpires time.Time, err error) {
 	host, port := unpackHealthStoreKey(healthStoreKey)
 	qName := "_" + port + t.HealthCheckTXTPrefix + host
-	txts, err := t.netResolver.LookupTXT(context.Background(), qName)
+	txt, urlExpires, err := t.lookupHealthCheckURI(ctx, qName)
+	if err != nil {
+		txt, urlExpires, err = t.lookupHealthCheckTXT(ctx, qName)
+	}
+	if err != nil && len(ceh.srvName) > 0 {
+		svcQName := strings.Trim(t.HealthCheckTXTPrefix, ".") + "." + ceh.srvName
+		svcTxt, svcExpires, svcErr := t.lookupHealthCheckTXT(ctx, svcQName)
+		if svcErr == nil {
+			qName, urlExpires, err = svcQName, svcExpires, nil
+			txt, err = expandHealthCheckTemplate(svcTxt, ceh.srvName, host, port)
+			if err != nil {
+				return nil, urlExpires, err
+			}
+		}
+	}
 	if err != nil {
+		service := serviceFromSRVKey(ceh.srvName)
+		if len(service) > 0 && t.healthChecker(service) != nil {
+			spec, err = t.parseHealthCheckSpec(service+"://"+healthStoreKey), nil
+			t.healthStore.Lock()
+			ceh.url = spec.url // For reporting purposes only
+			t.healthStore.Unlock()
+		}
 		return // No TXT
 	}
-	hcURL := strings.Join(txts, "") // TXT is a slice of sub-strings so bang them all together
-	if len(hcURL) == 0 {
-		return // Empty string can't be fetched!
+	spec = t.parseHealthCheckSpec(txt)
+	if len(spec.url) == 0 {
+		return nil, urlExpires, fmt.Errorf("empty health check URL at %s", qName) // Can't be fetched!
 	}
 	t.healthStore.Lock()
-	ceh.url = hcURL        // For reporting purposes only
-	expires := ceh.expires // Extract under protection of the lock
+	ceh.url = spec.url // For reporting purposes only
 	t.healthStore.Unlock()
 
-	_, err = url.Parse(hcURL) // Check that the URL is in fact a URL
+	u, err := url.Parse(spec.url) // Check that the URL is in fact a URL
 	if err != nil {
-		return // Doesn't look like it!
+		return nil, urlExpires, err // Doesn't look like it!
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && t.healthChecker(u.Scheme) == nil {
+		return nil, urlExpires, fmt.Errorf("no HealthChecker for %s at %s", u.Scheme, qName)
 	}
 
-	// Run the health check until the ceh expires.
+	return
+}
 
-	sleepFor := time.Second // Only wait a short time for the first health check
-	for {
-		time.Sleep(sleepFor)
-		sleepFor = t.HealthCheckFrequency // Second and subsequents wait a normal amount of time
-		now := time.Now()
-		if expires.Before(now) {
-			return
+// lookupHealthCheckTXT looks up the health check TXT RR. If the resolver returns TTLs, expires is
+// set to when the TXT should be re-fetched, otherwise it IsZero().
+func (t *cslb) lookupHealthCheckTXT(ctx context.Context, qName string) (txt string, expires time.Time, err error) {
+	var txts []string
+	if tr, ok := t.netResolver.(ttlResolver); ok {
+		var ttl time.Duration
+		txts, ttl, err = tr.lookupTXTTTL(ctx, qName)
+		if err == nil {
+			expires = time.Now().Add(dnsTTL(ttl, t.HealthTTL))
 		}
+	} else {
+		txts, err = t.netResolver.LookupTXT(ctx, qName)
+	}
 
-		resp, err := t.hcClient.Get(hcURL)
-		if err != nil {
-			if t.PrintHCResults {
-				fmt.Println("Health Check:", healthStoreKey, err)
-			}
-			t.healthStore.Lock()
-			ceh.unHealthy = true
-			ceh.lastHealthCheck = now
-			ceh.lastHealthCheckStatus = err.Error()
-			t.healthStore.Unlock()
-			return // Fatal error - leave the ceh to its own devices
+	return strings.Join(txts, ""), expires, err // TXT is a slice of sub-strings so bang them all together
+}
+
+var errNoURIResolver = errors.New("resolver does not support URI RRs")
+
+// lookupHealthCheckURI looks up the health check URI RRs and returns the target of the selected
+// URI. As with SRVs, the URI is selected by weight from amongst those with the lowest priority. An
+// error is returned if the resolver doesn't support URI RRs.
+func (t *cslb) lookupHealthCheckURI(ctx context.Context, qName string) (target string, expires time.Time, err error) {
+	ur, ok := t.netResolver.(uriResolver)
+	if !ok {
+		return "", expires, errNoURIResolver
+	}
+	uris, ttl, err := ur.lookupURITTL(ctx, qName)
+	if err != nil {
+		return "", expires, err
+	}
+	target = selectURI(uris, t.randIntn)
+	if len(target) == 0 {
+		return "", expires, &net.DNSError{Name: qName, Err: "no URI target", IsNotFound: true}
+	}
+
+	return target, time.Now().Add(dnsTTL(ttl, t.HealthTTL)), nil
+}
+
+// selectURI picks the target of a URI RR as per RFC7553, that is, with the same rules as RFC2782
+// SRVs. Weighted random selection is used amongst the lowest priority URIs with a non-empty target.
+func selectURI(uris []*dnsURI, randIntn func(int) int) string {
+	var best []*dnsURI
+	totalWeight := 0
+	for _, uri := range uris {
+		if len(uri.Target) == 0 {
+			continue
 		}
-		body, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			if t.PrintHCResults {
-				fmt.Println("Health Check:", healthStoreKey, err)
-			}
+		if len(best) > 0 && uri.Priority > best[0].Priority {
 			continue
 		}
+		if len(best) > 0 && uri.Priority < best[0].Priority {
+			best = best[:0]
+			totalWeight = 0
+		}
+		best = append(best, uri)
+		totalWeight += int(uri.Weight)
+	}
+	if len(best) == 0 {
+		return ""
+	}
+	if totalWeight == 0 { // All zero weights have an equal chance
+		return best[randIntn(len(best))].Target
+	}
 
-		ok := resp.StatusCode == http.StatusOK && bytes.Contains(body, []byte(t.HealthCheckContentOk))
-		if t.PrintHCResults {
-			fmt.Println("Health Check Set:", healthStoreKey, ok)
+	r := randIntn(totalWeight)
+	for _, uri := range best {
+		r -= int(uri.Weight)
+		if r < 0 {
+			return uri.Target
 		}
-		t.healthStore.Lock()
-		ceh.unHealthy = !ok
-		ceh.lastHealthCheck = now
-		ceh.lastHealthCheckStatus = resp.Status
-		t.healthStore.Unlock()
 	}
+
+	return best[len(best)-1].Target // Not reached
+}
+
+// hcTemplateData is the data available to a service-level health check template
+type hcTemplateData struct {
+	Target  string // Target host name from the SRV without any trailing dot
+	Port    string // Port from the SRV
+	Service string // E.g. "https" from _https._tcp.example.net
+	SRVName string // E.g. _https._tcp.example.net
+}
+
+// expandHealthCheckTemplate expands the service-level health check template for the target.
+func expandHealthCheckTemplate(tmpl, srvName, host, port string) (string, error) {
+	tt, err := template.New("hc").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	err = tt.Execute(&sb, hcTemplateData{Target: strings.TrimSuffix(host, "."), Port: port,
+		Service: serviceFromSRVKey(srvName), SRVName: srvName})
+	if err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
 }
 
 // cleaner periodically scans the cache to delete expired entries. Normally run as a go-routine.
@@ -223,6 +815,14 @@ func (t *healthCache) clean(now time.Time) {
 	for key, ceh := range t.cache {
 		if ceh.expires.Before(now) {
 			delete(t.cache, key)
+			if ceh.conns.openConns() > 0 { // Retain for the next ceHealth of this target
+				t.retired[key] = ceh.conns
+			}
+		}
+	}
+	for key, stats := range t.retired {
+		if stats.openConns() == 0 {
+			delete(t.retired, key)
 		}
 	}
 }
@@ -232,6 +832,7 @@ type ceHealthAsStats struct {
 	Key                   string
 	GoodDials             int
 	FailedDials           int
+	DialFailures          int
 	Expires               time.Duration // In the future
 	NextDialAttempt       time.Duration // In the future
 	LastDialAttempt       time.Duration // In the past
@@ -239,6 +840,16 @@ type ceHealthAsStats struct {
 	LastHealthCheck       time.Duration // In the past
 	LastHealthCheckStatus string
 	Url                   string
+	WeightBias            string
+	HCFailures            int
+	RiseFall              string
+	Dialing               int
+	RTT                   time.Duration
+	OpenConns             int
+	ClosedConns           int64
+	BytesRead             int64
+	BytesWritten          int64
+	ConnLifetime          time.Duration // Average of closed connections
 	IsGood                bool
 }
 
@@ -260,10 +871,27 @@ func (t *healthCache) getStats() *healthStats {
 			Key:            k,
 			GoodDials:      v.goodDials,
 			FailedDials:    v.failedDials,
+			DialFailures:   v.dialFailures,
 			LastDialStatus: trimTo(v.lastDialStatus, 60),
 			Url:            v.url,
+			HCFailures:     v.hcFailures,
+			Dialing:        v.dialing,
+			RTT:            v.rtt.Round(time.Microsecond),
 			IsGood:         v.isGood(now),
 		}
+		if v.rise > 0 {
+			entry.RiseFall = fmt.Sprintf("%d/%d", v.rise, v.fall)
+		}
+		if v.weightBias != 0 {
+			entry.WeightBias = strconv.FormatFloat(v.weightBias, 'f', 3, 64)
+		}
+		if v.conns != nil {
+			entry.OpenConns = v.conns.openConns()
+			entry.ClosedConns = atomic.LoadInt64(&v.conns.closed)
+			entry.BytesRead = atomic.LoadInt64(&v.conns.bytesRead)
+			entry.BytesWritten = atomic.LoadInt64(&v.conns.bytesWritten)
+			entry.ConnLifetime = v.conns.averageLifetime().Truncate(time.Second)
+		}
 		if !v.expires.IsZero() {
 			entry.Expires = v.expires.Sub(now).Truncate(time.Second)
 		}
@@ -1,7 +1,19 @@
 package cslb
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -9,7 +21,15 @@ import (
 // Much of health is checked indirectly via srv_test so this test module only tests those things
 // that are missed.
 
-// Test the health check go-routine
+// runHealthCheckTask runs the health check task for the target synchronously until it is dropped.
+func runHealthCheckTask(cslb *cslb, healthStoreKey string, ceh *ceHealth) {
+	task := &hcTask{key: healthStoreKey, ceh: ceh, next: time.Now()}
+	for cslb.runHealthCheck(context.Background(), task) {
+		time.Sleep(time.Until(task.next))
+	}
+}
+
+// Test the health check task
 func TestHealthFetchAndRun(t *testing.T) {
 	cslb := realInit()
 	mr := newMockResolver()
@@ -26,18 +46,18 @@ func TestHealthFetchAndRun(t *testing.T) {
 
 	ceh := &ceHealth{expires: time.Now().Add(time.Second * 3)}
 
-	cslb.fetchAndRunHealthCheck(makeHealthStoreKey("s2.example.net", 80), ceh)
+	runHealthCheckTask(cslb, makeHealthStoreKey("s2.example.net", 80), ceh)
 	if ceh.unHealthy {
 		t.Error("Fetch should have failed as URL in TXT is bogus", ceh.url)
 	}
 	ceh = &ceHealth{expires: time.Now().Add(time.Second * 3)}
-	cslb.fetchAndRunHealthCheck(makeHealthStoreKey("s1.example.net", 80), ceh)
+	runHealthCheckTask(cslb, makeHealthStoreKey("s1.example.net", 80), ceh)
 	if !ceh.unHealthy {
 		t.Error("Expected unhealthy to be set as Content should't match")
 	}
 	cslb.HealthCheckContentOk = "html" // Make it something google is bound to return
 	ceh = &ceHealth{expires: time.Now().Add(time.Second * 3)}
-	cslb.fetchAndRunHealthCheck(makeHealthStoreKey("s1.example.net", 80), ceh)
+	runHealthCheckTask(cslb, makeHealthStoreKey("s1.example.net", 80), ceh)
 	if ceh.unHealthy {
 		t.Error("Expected healthy to be set as Content should match")
 	}
@@ -86,3 +106,485 @@ func TestTrimTo(t *testing.T) {
 		t.Error("Extremely short trimTo not converted to ...", s)
 	}
 }
+
+func TestHealthEvalJSON(t *testing.T) {
+	cslb := realInit()
+	testCases := []struct {
+		contentType string
+		status      int
+		body        string
+		ok          bool
+		bias        float64
+	}{
+		{"text/plain", 200, "All OK", true, 0},
+		{"text/plain", 200, "All Bad", false, 0},
+		{"text/plain", 500, "All OK", false, 0},
+		{"application/json", 200, `{"status":"ok"}`, true, 0},
+		{"application/json", 200, `{"status":"OK","utilization":0.25}`, true, 0.75},
+		{"application/json", 200, `{"status":"ok","weight":50}`, true, 0.5},
+		{"application/json", 200, `{"status":"ok","utilization":0.5,"weight":200}`, true, 1.0},
+		{"application/json", 200, `{"status":"ok","utilization":1}`, true, 0.001},
+		{"application/json", 200, `{"status":"ok","utilization":-3}`, true, 1.0},
+		{"application/json; charset=utf-8", 200, `{"status":"down","utilization":0.1}`, false, 0},
+		{"application/json", 200, `OK but not json`, false, 0},
+		{"application/json", 503, `{"status":"ok"}`, false, 0},
+	}
+
+	spec := cslb.parseHealthCheckSpec("http://example.net/hc")
+	for ix, tc := range testCases {
+		resp := &http.Response{StatusCode: tc.status, Header: make(http.Header)}
+		resp.Header.Set("Content-Type", tc.contentType)
+		ok, bias := evalHealthCheck(spec, resp, []byte(tc.body))
+		if ok != tc.ok || math.Abs(bias-tc.bias) > 0.0001 {
+			t.Error(ix, "Expected", tc.ok, tc.bias, "got", ok, bias, tc.body)
+		}
+	}
+}
+
+// mockHCTransport fails the first "fail" requests with a transport error then returns a good
+// response.
+type mockHCTransport struct {
+	mu       sync.Mutex
+	fail     int
+	requests int
+}
+
+func (t *mockHCTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.requests++
+	if t.requests <= t.fail {
+		return nil, fmt.Errorf("mock connection refused")
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: make(http.Header),
+		Body: ioutil.NopCloser(strings.NewReader("OK")), Request: req}, nil
+}
+
+// Test that health checks continue after transport errors and that the target recovers
+func TestHealthRetry(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	mr.appendTXT("_80"+cslb.HealthCheckTXTPrefix+"s1.example.net", []string{"http://s1.example.net/hc"})
+	cslb.netResolver = mr
+	mt := &mockHCTransport{fail: 2}
+	cslb.hcClient = &http.Client{Transport: mt}
+	cslb.start()
+	defer cslb.stop()
+
+	ceh := &ceHealth{expires: time.Now().Add(time.Second * 5)}
+	cslb.scheduleHealthCheck(time.Now(), makeHealthStoreKey("s1.example.net", 80), ceh)
+
+	time.Sleep(time.Second*2 + time.Second/2) // First check at 1s and first retry at 2s
+	cslb.healthStore.RLock()
+	unHealthy, failures := ceh.unHealthy, ceh.hcFailures
+	cslb.healthStore.RUnlock()
+	if !unHealthy || failures != 2 {
+		t.Error("Expected unhealthy with two consecutive failures", unHealthy, failures)
+	}
+
+	time.Sleep(time.Second * 2) // Second retry at 4s should succeed
+	cslb.healthStore.RLock()
+	unHealthy, failures = ceh.unHealthy, ceh.hcFailures
+	cslb.healthStore.RUnlock()
+	if unHealthy || failures != 0 {
+		t.Error("Expected target to have recovered", unHealthy, failures)
+	}
+}
+
+func TestHealthBackoff(t *testing.T) {
+	testCases := []struct {
+		failures int
+		expect   time.Duration
+	}{{1, time.Second}, {2, time.Second * 2}, {3, time.Second * 4}, {6, time.Second * 32},
+		{7, time.Second * 50}, {100, time.Second * 50}}
+	for _, tc := range testCases {
+		got := healthCheckBackoff(tc.failures, time.Second*50)
+		if got != tc.expect {
+			t.Error("Backoff for", tc.failures, "expected", tc.expect, "got", got)
+		}
+	}
+}
+
+func TestHealthParseSpec(t *testing.T) {
+	cslb := realInit()
+	cslb.HealthCheckRise = 2
+	cslb.HealthCheckFall = 3
+	testCases := []struct {
+		txt        string
+		url        string
+		rise, fall int
+	}{
+		{"http://a/hc", "http://a/hc", 2, 3},
+		{"http://a/hc?x=y rise=4", "http://a/hc?x=y", 4, 3},
+		{"http://a/hc  FALL=5\trise=1", "http://a/hc", 1, 5},
+		{"http://a/hc rise=0 fall=x", "http://a/hc", 2, 3},    // Invalid values ignored
+		{"http://a/hc rise=100 junk =1", "http://a/hc", 2, 3}, // Out of range ignored
+		{"", "", 2, 3},
+	}
+	for _, tc := range testCases {
+		spec := cslb.parseHealthCheckSpec(tc.txt)
+		if spec.url != tc.url || spec.rise != tc.rise || spec.fall != tc.fall {
+			t.Error("Parse", tc.txt, "expected", tc.url, tc.rise, tc.fall, "got", spec)
+		}
+	}
+}
+
+// Test rise/fall hysteresis of health check results
+func TestHealthRiseFall(t *testing.T) {
+	cslb := realInit()
+	spec := &hcSpec{rise: 2, fall: 3}
+	ceh := &ceHealth{}
+	now := time.Now()
+	results := []struct {
+		ok        bool
+		unHealthy bool
+	}{
+		{false, false}, {false, false}, {true, false}, // Success resets fall count
+		{false, false}, {false, false}, {false, true}, // Third consecutive failure removes
+		{true, true}, {false, true}, {true, true}, {true, false}, // Two consecutive successes reinstate
+	}
+	for ix, r := range results {
+		cslb.setHealthCheckResult(ceh, spec, now, r.ok, 0, "")
+		if ceh.unHealthy != r.unHealthy {
+			t.Error(ix, "Expected unHealthy", r.unHealthy, "after", r.ok)
+		}
+	}
+}
+
+func TestHealthParseSpecKeys(t *testing.T) {
+	cslb := realInit()
+	spec := cslb.parseHealthCheckSpec("url=https://x/health method=head expect=200-299,304 " +
+		"header=X-Probe:1 header=Host:svc.example.net timeout=2s interval=10s")
+	if spec.url != "https://x/health" || spec.method != "HEAD" || spec.body != "" {
+		t.Error("Unexpected url, method or body", spec.url, spec.method, spec.body)
+	}
+	if !spec.expects(204) || !spec.expects(304) || spec.expects(301) || spec.expects(500) {
+		t.Error("Unexpected status ranges", spec.expect)
+	}
+	if spec.headers.Get("X-Probe") != "1" || spec.headers.Get("Host") != "svc.example.net" {
+		t.Error("Unexpected headers", spec.headers)
+	}
+	if spec.timeout != time.Second*2 || spec.interval != time.Second*10 {
+		t.Error("Unexpected timeout or interval", spec.timeout, spec.interval)
+	}
+
+	spec = cslb.parseHealthCheckSpec("http://x/hc body=READY expect=600 timeout=forever")
+	if spec.url != "http://x/hc" || spec.method != "GET" || spec.body != "READY" {
+		t.Error("Unexpected url, method or body", spec.url, spec.method, spec.body)
+	}
+	if !spec.expects(200) || spec.expects(600) || spec.timeout != cslb.HealthCheckTimeout {
+		t.Error("Invalid values should have been ignored", spec.expect, spec.timeout)
+	}
+
+	spec = cslb.parseHealthCheckSpec("http://x/hc timeout=500ms interval=250ms")
+	if spec.timeout != time.Millisecond*500 || spec.interval != time.Millisecond*250 {
+		t.Error("Expected sub-second timeout and interval", spec.timeout, spec.interval)
+	}
+	spec = cslb.parseHealthCheckSpec("http://x/hc timeout=1ms interval=10ms")
+	if spec.timeout != cslb.HealthCheckTimeout || spec.interval != cslb.HealthCheckFrequency {
+		t.Error("Expected too short timeout and interval to be ignored", spec.timeout, spec.interval)
+	}
+}
+
+// Test that the spec controls the http request and evaluation of the response
+func TestHealthProbeSpec(t *testing.T) {
+	cslb := realInit()
+	var gotMethod, gotProbe, gotHost string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod, gotProbe, gotHost = r.Method, r.Header.Get("X-Probe"), r.Host
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	spec := cslb.parseHealthCheckSpec("url=" + ts.URL + " method=HEAD expect=200-299 header=X-Probe:1" +
+		" header=Host:svc.example.net")
+	ok, _, status, err := cslb.probe(context.Background(), spec)
+	if !ok || err != nil {
+		t.Error("Expected HEAD probe to succeed", status, err)
+	}
+	if gotMethod != "HEAD" || gotProbe != "1" || gotHost != "svc.example.net" {
+		t.Error("Request did not match spec", gotMethod, gotProbe, gotHost)
+	}
+
+	spec = cslb.parseHealthCheckSpec(ts.URL) // Default expects a 200 with "OK" in the body
+	ok, _, status, err = cslb.probe(context.Background(), spec)
+	if ok || err != nil {
+		t.Error("Expected default GET probe to fail", status, err)
+	}
+}
+
+// Test that the health check client honors the timeout, body limit and TLS config options
+func TestHealthClientLimits(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(time.Second * 2)
+		case "/big":
+			w.Write(bytes.Repeat([]byte("x"), 1024))
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	cslb := newCslbWithOptions(Options{HealthCheckMaxBody: 1000, DisableHealthChecks: true})
+	ok, _, _, err := cslb.probe(context.Background(), cslb.parseHealthCheckSpec(ts.URL+"/"))
+	if err == nil {
+		t.Error("Expected an unknown CA error without a custom TLS config", ok)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	cslb = newCslbWithOptions(Options{HealthCheckMaxBody: 1000, DisableHealthChecks: true,
+		HealthCheckTLSConfig: &tls.Config{RootCAs: pool}})
+	ok, _, _, err = cslb.probe(context.Background(), cslb.parseHealthCheckSpec(ts.URL+"/"))
+	if !ok || err != nil {
+		t.Error("Expected success with a custom TLS config", err)
+	}
+	ok, _, _, err = cslb.probe(context.Background(), cslb.parseHealthCheckSpec(ts.URL+"/big"))
+	if ok || err != nil {
+		t.Error("Expected OK beyond HealthCheckMaxBody to be ignored", ok, err)
+	}
+	ok, _, _, err = cslb.probe(context.Background(), cslb.parseHealthCheckSpec(ts.URL+"/slow timeout=1s"))
+	if err == nil {
+		t.Error("Expected slow health check to time out", ok)
+	}
+	u, _ := url.Parse(ts.URL)
+	ok, _, _, err = cslb.probe(context.Background(), cslb.parseHealthCheckSpec("tls://"+u.Host))
+	if !ok || err != nil {
+		t.Error("Expected tls probe to succeed with a custom TLS config", err)
+	}
+}
+
+func TestHealthLoadTLSConfig(t *testing.T) {
+	config, err := loadTLSConfig("", "", "")
+	if err != nil || config == nil {
+		t.Error("Empty files should give an empty config", err)
+	}
+	_, err = loadTLSConfig("testdata/does-not-exist.pem", "", "")
+	if err == nil {
+		t.Error("Expected error from a missing CA file")
+	}
+	_, err = loadTLSConfig("", "testdata/does-not-exist.pem", "")
+	if err == nil {
+		t.Error("Expected error from a missing cert file")
+	}
+}
+
+// Test that a service-level health check template is used when a target has no TXT of its own
+func TestHealthServiceTemplate(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	mr.appendTXT("_cslb._https._tcp.example.net", []string{"https://{{.Target}}:{{.Port}}", "/healthz rise=2"})
+	mr.appendTXT("_443._cslb.h2.example.net", []string{"http://central.example.net/h2"})
+	mr.appendTXT("_cslb._https._tcp.bad.example.net", []string{"https://{{.Nope}}/healthz"})
+	cslb.netResolver = mr
+
+	ceh := &ceHealth{srvName: "_https._tcp.example.net"}
+	spec, _, err := cslb.fetchHealthCheckSpec(context.Background(), "h1.example.net.:443", ceh)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if spec.url != "https://h1.example.net:443/healthz" || spec.rise != 2 || ceh.url != spec.url {
+		t.Error("Template not expanded as expected", spec.url, spec.rise, ceh.url)
+	}
+
+	spec, _, err = cslb.fetchHealthCheckSpec(context.Background(), "h2.example.net:443", ceh)
+	if err != nil || spec.url != "http://central.example.net/h2" {
+		t.Error("Target TXT should take precedence over the template", spec, err)
+	}
+
+	ceh = &ceHealth{srvName: "_https._tcp.bad.example.net"}
+	_, _, err = cslb.fetchHealthCheckSpec(context.Background(), "h3.example.net:443", ceh)
+	if err == nil {
+		t.Error("Expected an error from a template with a missing key")
+	}
+
+	ceh = &ceHealth{srvName: "_https._tcp.none.example.net"}
+	_, _, err = cslb.fetchHealthCheckSpec(context.Background(), "h4.example.net:443", ceh)
+	if err == nil {
+		t.Error("Expected an error when there is no TXT at all")
+	}
+}
+
+func TestHealthSelectURI(t *testing.T) {
+	uris := []*dnsURI{{2, 100, "http://p2"}, {1, 10, "http://a"}, {1, 0, ""}, {1, 30, "http://b"}}
+	testCases := []struct {
+		r      int
+		expect string
+	}{{0, "http://a"}, {9, "http://a"}, {10, "http://b"}, {39, "http://b"}}
+	for _, tc := range testCases {
+		got := selectURI(uris, func(n int) int {
+			if n != 40 {
+				t.Fatal("Expected total weight of lowest priority to be 40, not", n)
+			}
+			return tc.r
+		})
+		if got != tc.expect {
+			t.Error("selectURI with", tc.r, "expected", tc.expect, "got", got)
+		}
+	}
+
+	got := selectURI([]*dnsURI{{1, 0, "http://a"}, {1, 0, "http://b"}}, func(n int) int { return n - 1 })
+	if got != "http://b" {
+		t.Error("Zero weight URIs should be selected uniformly", got)
+	}
+	if selectURI([]*dnsURI{{1, 10, ""}}, func(n int) int { return 0 }) != "" {
+		t.Error("Empty targets should never be selected")
+	}
+}
+
+// Test that a URI RR is preferred over a TXT RR
+func TestHealthFetchURI(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	mr.appendURI("_80"+cslb.HealthCheckTXTPrefix+"s1.example.net", 1, 1, "http://s1.example.net/uri")
+	mr.appendTXT("_80"+cslb.HealthCheckTXTPrefix+"s1.example.net", []string{"http://s1.example.net/txt"})
+	mr.appendTXT("_80"+cslb.HealthCheckTXTPrefix+"s2.example.net", []string{"http://s2.example.net/txt"})
+	cslb.netResolver = mr
+
+	spec, expires, err := cslb.fetchHealthCheckSpec(context.Background(), makeHealthStoreKey("s1.example.net", 80), &ceHealth{})
+	if err != nil || spec.url != "http://s1.example.net/uri" {
+		t.Error("Expected URI RR to take precedence", spec, err)
+	}
+	if expires.IsZero() {
+		t.Error("URI RR should have a re-fetch time")
+	}
+	spec, _, err = cslb.fetchHealthCheckSpec(context.Background(), makeHealthStoreKey("s2.example.net", 80), &ceHealth{})
+	if err != nil || spec.url != "http://s2.example.net/txt" {
+		t.Error("Expected fall back to TXT RR", spec, err)
+	}
+}
+
+// Test the RTT EWMA and that health checks only contribute to it when HealthCheckRTT is set
+func TestHealthRTT(t *testing.T) {
+	ceh := &ceHealth{}
+	ceh.addRTTSample(time.Millisecond * 100)
+	if ceh.rtt != time.Millisecond*100 {
+		t.Error("First sample should be taken as is, not", ceh.rtt)
+	}
+	ceh.addRTTSample(time.Millisecond * 20)
+	if ceh.rtt != time.Millisecond*80 {
+		t.Error("Expected EWMA of 80ms, not", ceh.rtt)
+	}
+	ceh.rtt = 1
+	ceh.addRTTSample(0)
+	if ceh.rtt == 0 {
+		t.Error("RTT should never return to unknown")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 200) // Server processing must not count towards the RTT
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	for _, enabled := range []bool{false, true} {
+		cslb := newCslbWithOptions(Options{HealthCheckRTT: enabled}) // New client so no idle conns
+		ceh := &ceHealth{expires: time.Now().Add(time.Minute)}
+		task := &hcTask{key: "s1.example.net:80", ceh: ceh, spec: cslb.parseHealthCheckSpec(ts.URL),
+			next: time.Now()}
+		if !cslb.runHealthCheck(context.Background(), task) || ceh.unHealthy {
+			t.Fatal("Expected a healthy check to be re-scheduled", ceh.lastHealthCheckStatus)
+		}
+		if enabled != (ceh.rtt > 0) || ceh.rtt >= time.Millisecond*200 {
+			t.Error("HealthCheckRTT", enabled, "but RTT is", ceh.rtt)
+		}
+	}
+}
+
+// Test that a transient failure to fetch the health check URL is retried with backoff and that only
+// a definitive not found drops the task.
+func TestHealthFetchRetry(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	mr.appendTXT("_80"+cslb.HealthCheckTXTPrefix+"s1.example.net", []string{"http://s1.example.net/hc"})
+	mr.txtErr = &net.DNSError{Err: "i/o timeout", IsTimeout: true, IsTemporary: true}
+	cslb.netResolver = mr
+
+	ceh := &ceHealth{expires: time.Now().Add(time.Minute)}
+	task := &hcTask{key: makeHealthStoreKey("s1.example.net", 80), ceh: ceh, next: time.Now()}
+	for ix := 1; ix <= 3; ix++ {
+		if !cslb.runHealthCheck(context.Background(), task) {
+			t.Fatal("Transient fetch failure should not drop the task")
+		}
+		if task.spec != nil || task.fetchFailures != ix {
+			t.Error("Expected no spec and failure count of", ix, task.spec, task.fetchFailures)
+		}
+	}
+	if delay := time.Until(task.next); delay < time.Second*2 || delay > time.Second*5 {
+		t.Error("Expected the third retry to back off to about 4s, not", delay)
+	}
+
+	mr.txtErr = nil
+	if !cslb.runHealthCheck(context.Background(), task) || task.spec == nil {
+		t.Error("Expected the spec once the DNS recovers")
+	}
+
+	task = &hcTask{key: makeHealthStoreKey("s2.example.net", 80), ceh: ceh, next: time.Now()}
+	if cslb.runHealthCheck(context.Background(), task) {
+		t.Error("A target with no health check should be dropped")
+	}
+
+	mr.txtErr = &net.DNSError{Err: "i/o timeout", IsTimeout: true, IsTemporary: true}
+	ceh.expires = time.Now().Add(-time.Second)
+	task = &hcTask{key: makeHealthStoreKey("s1.example.net", 80), ceh: ceh, next: time.Now()}
+	if cslb.runHealthCheck(context.Background(), task) {
+		t.Error("Retries should stop once the ceHealth entry expires")
+	}
+}
+
+// Test that consecutive dial failures back off the veto exponentially and success resets it
+func TestHealthDialVetoBackoff(t *testing.T) {
+	cslb := realInit()
+	cslb.DisableHealthChecks = true
+	cslb.DialVetoDuration = time.Second * 10
+	cslb.DialVetoMaxDuration = time.Second * 60
+	now := time.Now()
+	cslb.populateHealthStore(now, "", []string{"s1.example.net:80"})
+	ceh := cslb.healthStore.cache["s1.example.net:80"]
+
+	for ix, expect := range []time.Duration{10, 20, 40, 60, 60} {
+		cslb.setDialResult(now, "s1.example.net", 80, fmt.Errorf("refused"))
+		expect *= time.Second
+		veto := ceh.nextDialAttempt.Sub(now)
+		if ceh.dialFailures != ix+1 || veto < expect*9/10 || veto > expect*11/10 ||
+			veto < cslb.DialVetoDuration || veto > cslb.DialVetoMaxDuration {
+			t.Error("Failure", ix+1, "expected veto of about", expect, "got", veto, ceh.dialFailures)
+		}
+	}
+
+	cslb.setDialResult(now, "s1.example.net", 80, nil)
+	if ceh.dialFailures != 0 || !ceh.nextDialAttempt.IsZero() {
+		t.Error("Expected success to reset the backoff", ceh.dialFailures, ceh.nextDialAttempt)
+	}
+	cslb.setDialResult(now, "s1.example.net", 80, fmt.Errorf("refused"))
+	if veto := ceh.nextDialAttempt.Sub(now); veto > time.Second*11 {
+		t.Error("Expected minimum veto after reset, not", veto)
+	}
+
+	cslb = newCslbWithOptions(Options{DialVetoDuration: time.Hour, DisableHealthChecks: true})
+	if cslb.DialVetoMaxDuration != time.Hour {
+		t.Error("DialVetoMaxDuration should be raised to DialVetoDuration, not", cslb.DialVetoMaxDuration)
+	}
+}
+
+// Test that health check lookups are abandoned when the scheduler context is cancelled
+func TestHealthFetchCancel(t *testing.T) {
+	silent, _ := net.ListenPacket("udp", "127.0.0.1:0") // Never responds
+	defer silent.Close()
+	cslb := newCslbWithOptions(Options{DNSServers: silent.LocalAddr().String(), DisableHealthChecks: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+	start := time.Now()
+	_, _, err := cslb.fetchHealthCheckSpec(ctx, makeHealthStoreKey("s1.example.net", 80),
+		&ceHealth{srvName: "_http._tcp.example.net"})
+	if err == nil || time.Since(start) > time.Second*2 {
+		t.Error("Expected cancelled lookups to return promptly with an error", err, time.Since(start))
+	}
+}
@@ -0,0 +1,104 @@
+package cslb
+
+/*
+Health checkers are the probes run by runHealthCheck for health check URLs which are not
+http or https URLs. The URL scheme selects the checker so a TXT RR of "tcp://s1.example.net:6379"
+runs a TCP connect probe and "tls://s1.example.net:443" runs a TLS handshake probe. Applications can
+register their own checkers, such as a Redis PING, under any scheme name they like.
+
+A checker registered under an SRV service name (the "redis" in _redis._tcp.example.net) is also run
+against every target of that service which has no health check TXT RR. In that case the URL is
+synthesized as $service://$target:$port.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// HealthChecker is implemented by health check probes. Check is called periodically for a target
+// with the health check URL and returns nil if the target is healthy. Check must honor the context
+// deadline.
+type HealthChecker interface {
+	Check(ctx context.Context, hcURL *url.URL) error
+}
+
+// HealthCheckerFunc is an adapter which allows an ordinary function to be used as a HealthChecker.
+type HealthCheckerFunc func(ctx context.Context, hcURL *url.URL) error
+
+// Check calls f(ctx, hcURL)
+func (f HealthCheckerFunc) Check(ctx context.Context, hcURL *url.URL) error {
+	return f(ctx, hcURL)
+}
+
+// RegisterHealthChecker registers the HealthChecker with the package-level cslb instance. The name
+// is matched against the scheme of health check URLs and the service name of SRVs. Registering a
+// nil HealthChecker removes any previous registration. The "http" and "https" names are reserved
+// for the built-in http health check and cannot be registered.
+func RegisterHealthChecker(name string, hc HealthChecker) error {
+	return getCSLB().registerHealthChecker(name, hc)
+}
+
+// tcpHealthChecker is considered healthy if a TCP connection can be established to the URL host.
+type tcpHealthChecker struct {
+	dialer *net.Dialer
+}
+
+func (t *tcpHealthChecker) Check(ctx context.Context, hcURL *url.URL) error {
+	conn, err := t.dialer.DialContext(ctx, "tcp", hcURL.Host)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// tlsHealthChecker is considered healthy if a TLS handshake, including certificate verification,
+// completes with the URL host. The config supplies any custom root CA and client certificates.
+type tlsHealthChecker struct {
+	dialer *net.Dialer
+	config *tls.Config
+}
+
+func (t *tlsHealthChecker) Check(ctx context.Context, hcURL *url.URL) error {
+	config := t.config.Clone()
+	config.ServerName = hcURL.Hostname()
+	td := &tls.Dialer{NetDialer: t.dialer, Config: config}
+	conn, err := td.DialContext(ctx, "tcp", hcURL.Host) // Returns after handshake completes
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// registerHealthChecker adds or removes a health checker from the cslb registry.
+func (t *cslb) registerHealthChecker(name string, hc HealthChecker) error {
+	name = strings.ToLower(name)
+	if name == "http" || name == "https" || len(name) == 0 {
+		return fmt.Errorf("cslb: Cannot register a HealthChecker named '%s'", name)
+	}
+
+	t.checkersMu.Lock()
+	defer t.checkersMu.Unlock()
+
+	if hc == nil {
+		delete(t.healthCheckers, name)
+	} else {
+		t.healthCheckers[name] = hc
+	}
+
+	return nil
+}
+
+// healthChecker returns the registered health checker for the name or nil.
+func (t *cslb) healthChecker(name string) HealthChecker {
+	t.checkersMu.RLock()
+	defer t.checkersMu.RUnlock()
+
+	return t.healthCheckers[strings.ToLower(name)]
+}
@@ -0,0 +1,115 @@
+package cslb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerBuiltins(t *testing.T) {
+	cslb := realInit()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { // Accept and immediately close so the TLS handshake fails
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := ln.Addr().String()
+
+	ok, _, _, err := cslb.probe(context.Background(), cslb.parseHealthCheckSpec("tcp://"+addr))
+	if !ok || err != nil {
+		t.Error("tcp probe to listener should have succeeded", err)
+	}
+	_, _, _, err = cslb.probe(context.Background(), cslb.parseHealthCheckSpec("tls://"+addr))
+	if err == nil {
+		t.Error("tls probe to a non-TLS listener should have failed")
+	}
+
+	ln.Close()
+	_, _, _, err = cslb.probe(context.Background(), cslb.parseHealthCheckSpec("tcp://"+addr))
+	if err == nil {
+		t.Error("tcp probe to closed listener should have failed")
+	}
+
+	_, _, _, err = cslb.probe(context.Background(), cslb.parseHealthCheckSpec("redis://"+addr))
+	if err == nil {
+		t.Error("probe with unregistered scheme should have failed")
+	}
+}
+
+func TestHealthCheckerRegister(t *testing.T) {
+	cslb := realInit()
+	if cslb.registerHealthChecker("http", &tcpHealthChecker{}) == nil {
+		t.Error("Should not be able to register 'http'")
+	}
+	if cslb.registerHealthChecker("", &tcpHealthChecker{}) == nil {
+		t.Error("Should not be able to register an empty name")
+	}
+
+	var mu sync.Mutex
+	var checked []string
+	err := RegisterHealthChecker("Redis", HealthCheckerFunc(func(ctx context.Context, u *url.URL) error {
+		mu.Lock()
+		defer mu.Unlock()
+		checked = append(checked, u.String())
+		if u.Hostname() == "r2.example.net" {
+			return fmt.Errorf("-ERR not PONG")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cslb.healthChecker("redis") == nil {
+		t.Fatal("Expected a case-insensitive registration")
+	}
+
+	// r1 is selected by the service name as it has no TXT. r2 is selected by the TXT scheme.
+
+	mr := newMockResolver()
+	mr.appendSRV("redis", "tcp", "example.net", "r1.example.net", 6379, 1, 1)
+	mr.appendSRV("redis", "tcp", "example.net", "r2.example.net", 6379, 1, 1)
+	mr.appendTXT("_6379"+cslb.HealthCheckTXTPrefix+"r2.example.net", []string{"redis://r2.example.net:6379"})
+	cslb.netResolver = mr
+	cslb.HealthTTL = time.Second * 2
+	cslb.start()
+	defer cslb.stop()
+	cslb.lookupSRV(context.Background(), time.Now(), "redis", "tcp", "example.net")
+
+	time.Sleep(time.Second + time.Second/2) // First health check is after one second
+	cslb.healthStore.RLock()
+	r1 := cslb.healthStore.cache["r1.example.net:6379"]
+	r2 := cslb.healthStore.cache["r2.example.net:6379"]
+	if r1 == nil || r2 == nil {
+		t.Fatal("Expected both targets in the healthStore")
+	}
+	if r1.unHealthy || r1.url != "redis://r1.example.net:6379" {
+		t.Error("r1 should be healthy with a synthesized URL", r1.unHealthy, r1.url)
+	}
+	if !r2.unHealthy {
+		t.Error("r2 should be unhealthy")
+	}
+	cslb.healthStore.RUnlock()
+
+	mu.Lock()
+	if len(checked) != 2 {
+		t.Error("Expected two checks, not", checked)
+	}
+	mu.Unlock()
+
+	RegisterHealthChecker("redis", nil)
+	if cslb.healthChecker("redis") != nil {
+		t.Error("Expected registration to be removed")
+	}
+}
@@ -0,0 +1,575 @@
+package cslb
+
+/*
+The dnsResolver is a minimal DNS stub resolver which speaks the DNS wire protocol directly to a
+configured recursive server. It exists solely because the go resolver does not return TTLs so cslb
+otherwise has to guess how long to cache SRV and TXT RRs. With this resolver cslb caches RRs for as
+long as the zone operator intended.
+
+It is deliberately minimal. It only knows how to ask the questions cslb asks and only parses the RR
+types cslb cares about (plus SOA for negative caching). Answers are only accepted if they match both
+the query ID, which is chosen with crypto/rand, and the question. There is no DNSSEC validation. There
+are no package dependencies beyond the standard go packages.
+*/
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// ttlResolver is an optional extension of limitedResolver implemented by resolvers which are able
+// to return the TTL of their answers. For negative responses the returned error is a *net.DNSError
+// and the TTL is the negative caching TTL derived from the SOA, if present, otherwise noDNSTTL.
+type ttlResolver interface {
+	lookupSRVTTL(ctx context.Context, name string) (srvs []*net.SRV, ttl time.Duration, err error)
+	lookupTXTTTL(ctx context.Context, name string) (txts []string, ttl time.Duration, err error)
+}
+
+// uriResolver is an optional extension of limitedResolver implemented by resolvers which are able
+// to look up URI RRs (RFC7553). The go resolver cannot so URI RRs are only used with the built-in
+// resolver. The TTL and error semantics are the same as ttlResolver.
+type uriResolver interface {
+	lookupURITTL(ctx context.Context, name string) (uris []*dnsURI, ttl time.Duration, err error)
+}
+
+// dnsURI is the RDATA of a URI RR
+type dnsURI struct {
+	Priority uint16
+	Weight   uint16
+	Target   string
+}
+
+const (
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypeTXT   = 16
+	dnsTypeSRV   = 33
+	dnsTypeOPT   = 41
+	dnsTypeURI   = 256
+	dnsClassIN   = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+
+	dnsHeaderLen     = 12
+	dnsUDPBufferSize = 1232 // As recommended by DNS Flag Day 2020 and advertised with EDNS0
+	dnsMaxPointers   = 64   // Guards against compression pointer loops
+
+	defaultDNSTimeout = time.Second * 5 // Per server, per transport query timeout
+
+	noDNSTTL time.Duration = -1 // The response has no TTL - distinct from a TTL of zero
+)
+
+// dnsResolver implements limitedResolver, ttlResolver and uriResolver.
+type dnsResolver struct {
+	servers []string // host:port of each recursive server. Tried in order.
+	timeout time.Duration
+	dialer  net.Dialer
+	randID  func() uint16
+}
+
+// newDNSResolver creates a dnsResolver from a comma separated list of servers. Servers without a
+// port are given port 53.
+func newDNSResolver(servers string) *dnsResolver {
+	t := &dnsResolver{timeout: defaultDNSTimeout, randID: randQueryID}
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if len(server) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		t.servers = append(t.servers, server)
+	}
+
+	return t
+}
+
+// randQueryID returns an unpredictable query ID so that off-path attackers cannot easily spoof
+// responses.
+func randQueryID() uint16 {
+	var b [2]byte
+	if _, err := crand.Read(b[:]); err != nil { // Should never happen, but better than a fixed ID
+		return uint16(rand.Uint32())
+	}
+
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// LookupSRV implements limitedResolver. If service and proto are empty, name is used as the qName,
+// otherwise the qName is _$service._$proto.$name as with net.Resolver.
+func (t *dnsResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	qName := name
+	if len(service) != 0 || len(proto) != 0 {
+		qName = "_" + service + "._" + proto + "." + name
+	}
+	srvs, _, err := t.lookupSRVTTL(ctx, qName)
+
+	return qName, srvs, err
+}
+
+// LookupTXT implements limitedResolver
+func (t *dnsResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, _, err := t.lookupTXTTTL(ctx, name)
+
+	return txts, err
+}
+
+func (t *dnsResolver) lookupSRVTTL(ctx context.Context, name string) (srvs []*net.SRV, ttl time.Duration, err error) {
+	ans, err := t.query(ctx, name, dnsTypeSRV)
+	if err != nil {
+		return nil, ans.negativeTTL(), err
+	}
+	for _, rr := range ans.answers {
+		if rr.rrType == dnsTypeSRV {
+			srvs = append(srvs, rr.srv)
+		}
+	}
+
+	return srvs, ans.ttl(dnsTypeSRV), nil
+}
+
+func (t *dnsResolver) lookupTXTTTL(ctx context.Context, name string) (txts []string, ttl time.Duration, err error) {
+	ans, err := t.query(ctx, name, dnsTypeTXT)
+	if err != nil {
+		return nil, ans.negativeTTL(), err
+	}
+	for _, rr := range ans.answers {
+		if rr.rrType == dnsTypeTXT {
+			txts = append(txts, strings.Join(rr.txt, "")) // Same as net.Resolver.LookupTXT
+		}
+	}
+
+	return txts, ans.ttl(dnsTypeTXT), nil
+}
+
+func (t *dnsResolver) lookupURITTL(ctx context.Context, name string) (uris []*dnsURI, ttl time.Duration, err error) {
+	ans, err := t.query(ctx, name, dnsTypeURI)
+	if err != nil {
+		return nil, ans.negativeTTL(), err
+	}
+	for _, rr := range ans.answers {
+		if rr.rrType == dnsTypeURI {
+			uris = append(uris, rr.uri)
+		}
+	}
+
+	return uris, ans.ttl(dnsTypeURI), nil
+}
+
+// query sends the question to each server in turn until one of them gives a definitive answer. A
+// NXDomain or an empty answer is definitive and results in an IsNotFound error. Timeouts, network
+// errors and server failures cause the next server to be tried. The returned dnsAnswer is never nil.
+func (t *dnsResolver) query(ctx context.Context, name string, qType uint16) (*dnsAnswer, error) {
+	name = strings.TrimSuffix(name, ".")
+	dnsErr := &net.DNSError{Name: name, Err: "no DNS servers configured", IsTemporary: true}
+	if len(t.servers) == 0 {
+		return &dnsAnswer{}, dnsErr
+	}
+
+	msg, err := packQuery(t.randID(), name, qType)
+	if err != nil {
+		return &dnsAnswer{}, &net.DNSError{Name: name, Err: err.Error()}
+	}
+	for _, server := range t.servers {
+		dnsErr.Server = server
+		ans, err := t.exchange(ctx, server, msg)
+		if err != nil {
+			dnsErr.Err = err.Error()
+			var ne net.Error
+			dnsErr.IsTimeout = errors.As(err, &ne) && ne.Timeout()
+			dnsErr.IsTemporary = true
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		switch ans.rcode {
+		case dnsRcodeSuccess:
+			if ans.count(qType) > 0 {
+				return ans, nil
+			}
+			return ans, &net.DNSError{Name: name, Server: server, Err: "no such host", IsNotFound: true}
+		case dnsRcodeNXDomain:
+			return ans, &net.DNSError{Name: name, Server: server, Err: "no such host", IsNotFound: true}
+		default:
+			dnsErr.Err = fmt.Sprintf("server misbehaving (rcode=%d)", ans.rcode)
+			dnsErr.IsTimeout = false
+			dnsErr.IsTemporary = true
+		}
+	}
+
+	return &dnsAnswer{}, dnsErr
+}
+
+// exchange sends the query to the server over UDP and, if the response is truncated, re-sends the
+// query over TCP.
+func (t *dnsResolver) exchange(ctx context.Context, server string, msg []byte) (*dnsAnswer, error) {
+	resp, err := t.exchangeWith(ctx, "udp", server, msg)
+	if err != nil {
+		return nil, err
+	}
+	ans, err := unpackAnswer(resp, msg)
+	if err != nil {
+		return nil, err
+	}
+	if !ans.truncated {
+		return ans, nil
+	}
+
+	resp, err = t.exchangeWith(ctx, "tcp", server, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return unpackAnswer(resp, msg)
+}
+
+// exchangeWith performs a single query/response exchange over the nominated network. TCP messages
+// are prefixed with a two byte length as per RFC1035.
+func (t *dnsResolver) exchangeWith(ctx context.Context, network, server string, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	conn, err := t.dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) }) // Unblock on cancel
+	defer stop()
+
+	if network == "udp" {
+		if _, err = conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsUDPBufferSize)
+		for { // Skip any responses which don't match our ID - they may be late replies to someone else
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if n >= 2 && binary.BigEndian.Uint16(buf) == binary.BigEndian.Uint16(msg) {
+				return buf[:n], nil
+			}
+		}
+	}
+
+	tcpMsg := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(tcpMsg, uint16(len(msg)))
+	if _, err = conn.Write(append(tcpMsg, msg...)); err != nil {
+		return nil, err
+	}
+	lenBuf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, lenBuf); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// dnsRR is a parsed Resource Record. Only the field relevant to rrType is set.
+type dnsRR struct {
+	rrType uint16
+	ttl    uint32
+	srv    *net.SRV
+	txt    []string
+	uri    *dnsURI
+	soaMin uint32 // SOA MINIMUM field
+}
+
+// dnsAnswer is the parsed response message.
+type dnsAnswer struct {
+	rcode     int
+	truncated bool
+	answers   []*dnsRR
+	authority []*dnsRR
+}
+
+// count returns the number of answer RRs of the type
+func (t *dnsAnswer) count(rrType uint16) (count int) {
+	for _, rr := range t.answers {
+		if rr.rrType == rrType {
+			count++
+		}
+	}
+
+	return
+}
+
+// ttl returns the smallest TTL of the answer RRs of the type and any CNAMEs which led to them or
+// noDNSTTL if there are no such RRs.
+func (t *dnsAnswer) ttl(rrType uint16) time.Duration {
+	var smallest uint32
+	found := false
+	for _, rr := range t.answers {
+		if rr.rrType == rrType || rr.rrType == dnsTypeCNAME {
+			if !found || rr.ttl < smallest {
+				smallest = rr.ttl
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return noDNSTTL
+	}
+
+	return time.Duration(smallest) * time.Second
+}
+
+// negativeTTL returns the negative caching TTL as defined by RFC2308. That is, the lesser of the
+// SOA TTL and the SOA MINIMUM field. noDNSTTL is returned if there is no SOA in the authority
+// section.
+func (t *dnsAnswer) negativeTTL() time.Duration {
+	for _, rr := range t.authority {
+		if rr.rrType == dnsTypeSOA {
+			ttl := rr.ttl
+			if rr.soaMin < ttl {
+				ttl = rr.soaMin
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+
+	return noDNSTTL
+}
+
+// packQuery creates a recursion desired query message with an EDNS0 OPT RR advertising our UDP
+// buffer size.
+func packQuery(id uint16, name string, qType uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)      // QDCOUNT
+	binary.BigEndian.PutUint16(msg[10:], 1)     // ARCOUNT for the OPT RR
+
+	msg, err := packName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, qType)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	msg = append(msg, 0) // OPT RR has the root name
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, dnsUDPBufferSize) // CLASS is the UDP payload size
+	msg = binary.BigEndian.AppendUint32(msg, 0)                // TTL is extended RCODE and flags
+	msg = binary.BigEndian.AppendUint16(msg, 0)                // RDLENGTH
+
+	return msg, nil
+}
+
+// packName appends the uncompressed wire-format of the name to the message.
+func packName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 0 {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid label in %s", name)
+			}
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	msg = append(msg, 0)
+	if len(msg) > 255+dnsHeaderLen { // Roughly. Good enough to stop absurd names.
+		return nil, fmt.Errorf("name too long %s", name)
+	}
+
+	return msg, nil
+}
+
+var errDNSShort = errors.New("short DNS message")
+
+// unpackName returns the possibly compressed name at offset along with the offset following the
+// name in the message.
+func unpackName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1 // Offset following the name once the first pointer is followed
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				off++
+				if next < 0 {
+					next = off
+				}
+				return strings.Join(labels, "."), next, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+c]))
+			off += 1 + c
+		case 0xC0:
+			if off+2 > len(msg) {
+				return "", 0, errDNSShort
+			}
+			pointers++
+			if pointers > dnsMaxPointers {
+				return "", 0, errors.New("too many DNS compression pointers")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			return "", 0, errors.New("invalid DNS label type")
+		}
+	}
+}
+
+// unpackAnswer parses the response message. The ID and the question must match those of the query.
+func unpackAnswer(msg, query []byte) (*dnsAnswer, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errDNSShort
+	}
+	if binary.BigEndian.Uint16(msg) != binary.BigEndian.Uint16(query) {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, errors.New("DNS message is not a response")
+	}
+	ans := &dnsAnswer{rcode: int(flags & 0x000F), truncated: flags&0x0200 != 0}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:]))
+	nsCount := int(binary.BigEndian.Uint16(msg[8:]))
+
+	if qdCount != 1 {
+		return nil, errors.New("DNS response does not have exactly one question")
+	}
+	qName, next, err := unpackName(query, dnsHeaderLen) // Our own query so it can't fail
+	if err != nil {
+		return nil, err
+	}
+	qType := binary.BigEndian.Uint16(query[next:])
+	name, off, err := unpackName(msg, dnsHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if off+4 > len(msg) {
+		return nil, errDNSShort
+	}
+	if !strings.EqualFold(name, qName) || binary.BigEndian.Uint16(msg[off:]) != qType {
+		return nil, errors.New("DNS response question mismatch")
+	}
+	off += 4 // QTYPE and QCLASS
+
+	if ans.truncated { // Don't bother parsing the rest as we're going to ask again over TCP
+		return ans, nil
+	}
+
+	for ix := 0; ix < anCount+nsCount; ix++ {
+		var rr *dnsRR
+		rr, off, err = unpackRR(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil { // Not a type we care about
+			continue
+		}
+		if ix < anCount {
+			ans.answers = append(ans.answers, rr)
+		} else {
+			ans.authority = append(ans.authority, rr)
+		}
+	}
+
+	return ans, nil
+}
+
+// unpackRR parses the RR at offset. A nil RR is returned for types we don't care about.
+func unpackRR(msg []byte, off int) (*dnsRR, int, error) {
+	_, off, err := unpackName(msg, off)
+	if err != nil {
+		return nil, 0, err
+	}
+	if off+10 > len(msg) {
+		return nil, 0, errDNSShort
+	}
+	rr := &dnsRR{rrType: binary.BigEndian.Uint16(msg[off:]), ttl: binary.BigEndian.Uint32(msg[off+4:])}
+	rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	end := off + rdLen
+	if end > len(msg) {
+		return nil, 0, errDNSShort
+	}
+	if rr.ttl > 0x7FFFFFFF { // RFC2181 says treat TTLs with the high bit set as zero
+		rr.ttl = 0
+	}
+
+	switch rr.rrType {
+	case dnsTypeCNAME:
+	case dnsTypeSRV:
+		if rdLen < 7 {
+			return nil, 0, errDNSShort
+		}
+		target, _, err := unpackName(msg, off+6)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(target) > 0 { // Fully qualified - same as net.Resolver - except that the root
+			target += "." // target is left empty so populate() ignores it as per RFC2782.
+		}
+		rr.srv = &net.SRV{Priority: binary.BigEndian.Uint16(msg[off:]),
+			Weight: binary.BigEndian.Uint16(msg[off+2:]),
+			Port:   binary.BigEndian.Uint16(msg[off+4:]),
+			Target: target}
+	case dnsTypeTXT:
+		for ix := off; ix < end; {
+			l := int(msg[ix])
+			if ix+1+l > end {
+				return nil, 0, errDNSShort
+			}
+			rr.txt = append(rr.txt, string(msg[ix+1:ix+1+l]))
+			ix += 1 + l
+		}
+	case dnsTypeURI:
+		if rdLen < 4 {
+			return nil, 0, errDNSShort
+		}
+		rr.uri = &dnsURI{Priority: binary.BigEndian.Uint16(msg[off:]),
+			Weight: binary.BigEndian.Uint16(msg[off+2:]),
+			Target: string(msg[off+4 : end])} // Not a <character-string> - it runs to the end of RDATA
+	case dnsTypeSOA:
+		_, next, err := unpackName(msg, off) // MNAME
+		if err != nil {
+			return nil, 0, err
+		}
+		_, next, err = unpackName(msg, next) // RNAME
+		if err != nil {
+			return nil, 0, err
+		}
+		if next+20 > end {
+			return nil, 0, errDNSShort
+		}
+		rr.soaMin = binary.BigEndian.Uint32(msg[next+16:])
+	default:
+		rr = nil
+	}
+
+	return rr, end, nil
+}
@@ -0,0 +1,351 @@
+package cslb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeDNS is a minimal DNS server for testing dnsResolver. The handler is given the query name and
+// type and returns the response flags (rcode and TC bit), answer RRs and authority RRs.
+type fakeDNS struct {
+	udp     net.PacketConn
+	tcp     net.Listener
+	handler fakeHandler
+}
+
+type fakeHandler func(tcp bool, name string, qType uint16) (flags uint16, answers, authority [][]byte)
+
+// newFakeDNS starts a fakeDNS. The handler is fixed before the server go-routines start as they read
+// it without any locking.
+func newFakeDNS(t *testing.T, handler fakeHandler) *fakeDNS {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String()) // Same port for both transports
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeDNS{udp: udp, tcp: tcp, handler: handler}
+	go f.serveUDP()
+	go f.serveTCP()
+
+	return f
+}
+
+func (t *fakeDNS) address() string {
+	return t.udp.LocalAddr().String()
+}
+
+func (t *fakeDNS) close() {
+	t.udp.Close()
+	t.tcp.Close()
+}
+
+func (t *fakeDNS) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := t.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		t.udp.WriteTo(t.respond(false, buf[:n]), addr)
+	}
+}
+
+func (t *fakeDNS) serveTCP() {
+	for {
+		conn, err := t.tcp.Accept()
+		if err != nil {
+			return
+		}
+		lenBuf := make([]byte, 2)
+		conn.Read(lenBuf)
+		buf := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		conn.Read(buf)
+		resp := t.respond(true, buf)
+		conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp))))
+		conn.Write(resp)
+		conn.Close()
+	}
+}
+
+// respond echoes the question back with the handler-supplied RRs appended
+func (t *fakeDNS) respond(tcp bool, query []byte) []byte {
+	name, off, _ := unpackName(query, dnsHeaderLen)
+	qType := binary.BigEndian.Uint16(query[off:])
+	flags, answers, authority := t.handler(tcp, name, qType)
+
+	resp := append([]byte{}, query[:off+4]...) // Header and question
+	binary.BigEndian.PutUint16(resp[2:], 0x8180|flags)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(resp[8:], uint16(len(authority)))
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	for _, rr := range answers {
+		resp = append(resp, rr...)
+	}
+	for _, rr := range authority {
+		resp = append(resp, rr...)
+	}
+
+	return resp
+}
+
+// fakeRR creates a wire-format RR. The owner name is a compression pointer to the question.
+func fakeRR(rrType uint16, ttl uint32, rdata []byte) []byte {
+	rr := []byte{0xC0, dnsHeaderLen}
+	rr = binary.BigEndian.AppendUint16(rr, rrType)
+	rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+
+	return append(rr, rdata...)
+}
+
+func fakeSRV(ttl uint32, priority, weight, port uint16, target string) []byte {
+	rdata := binary.BigEndian.AppendUint16(nil, priority)
+	rdata = binary.BigEndian.AppendUint16(rdata, weight)
+	rdata = binary.BigEndian.AppendUint16(rdata, port)
+	rdata, _ = packName(rdata, target)
+
+	return fakeRR(dnsTypeSRV, ttl, rdata)
+}
+
+func fakeTXT(ttl uint32, strs ...string) []byte {
+	var rdata []byte
+	for _, s := range strs {
+		rdata = append(rdata, byte(len(s)))
+		rdata = append(rdata, s...)
+	}
+
+	return fakeRR(dnsTypeTXT, ttl, rdata)
+}
+
+func fakeURI(ttl uint32, priority, weight uint16, target string) []byte {
+	rdata := binary.BigEndian.AppendUint16(nil, priority)
+	rdata = binary.BigEndian.AppendUint16(rdata, weight)
+
+	return fakeRR(dnsTypeURI, ttl, append(rdata, target...))
+}
+
+func fakeSOA(ttl, minimum uint32) []byte {
+	rdata, _ := packName(nil, "ns.example.net")
+	rdata, _ = packName(rdata, "hostmaster.example.net")
+	for _, v := range []uint32{1, 3600, 600, 86400, minimum} {
+		rdata = binary.BigEndian.AppendUint32(rdata, v)
+	}
+
+	return fakeRR(dnsTypeSOA, ttl, rdata)
+}
+
+func TestResolverSRV(t *testing.T) {
+	f := newFakeDNS(t, func(tcp bool, name string, qType uint16) (uint16, [][]byte, [][]byte) {
+		if name != "_http._tcp.example.net" || qType != dnsTypeSRV {
+			return dnsRcodeNXDomain, nil, [][]byte{fakeSOA(300, 60)}
+		}
+		return 0, [][]byte{fakeSRV(42, 1, 10, 8080, "s1.example.net"), fakeSRV(50, 2, 20, 8081, "s2.example.net")}, nil
+	})
+	defer f.close()
+
+	r := newDNSResolver(f.address())
+	srvs, ttl, err := r.lookupSRVTTL(context.Background(), "_http._tcp.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 42*time.Second {
+		t.Error("Expected smallest TTL of 42s, not", ttl)
+	}
+	if len(srvs) != 2 || srvs[0].Target != "s1.example.net." || srvs[0].Port != 8080 ||
+		srvs[1].Priority != 2 || srvs[1].Weight != 20 {
+		t.Error("SRVs not parsed correctly", srvs)
+	}
+
+	_, srvs, err = r.LookupSRV(context.Background(), "http", "tcp", "example.net") // limitedResolver interface
+	if err != nil || len(srvs) != 2 {
+		t.Error("LookupSRV should have returned two SRVs", srvs, err)
+	}
+
+	_, ttl, err = r.lookupSRVTTL(context.Background(), "_https._tcp.example.net")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatal("Expected IsNotFound DNSError, not", err)
+	}
+	if ttl != 60*time.Second {
+		t.Error("Expected negative TTL from SOA minimum of 60s, not", ttl)
+	}
+}
+
+// Test that a truncated UDP response is retried over TCP
+func TestResolverTCPFallback(t *testing.T) {
+	f := newFakeDNS(t, func(tcp bool, name string, qType uint16) (uint16, [][]byte, [][]byte) {
+		if !tcp {
+			return 0x0200, nil, nil // TC bit
+		}
+		return 0, [][]byte{fakeTXT(30, "http://", "example.net/health")}, nil
+	})
+	defer f.close()
+
+	r := newDNSResolver(f.address())
+	txts, ttl, err := r.lookupTXTTTL(context.Background(), "_80._cslb.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txts) != 1 || txts[0] != "http://example.net/health" || ttl != 30*time.Second {
+		t.Error("Unexpected TXT response", txts, ttl)
+	}
+}
+
+// Test that server failures and unresponsive servers result in a temporary error and that the next
+// server is tried.
+func TestResolverFailures(t *testing.T) {
+	f := newFakeDNS(t, func(tcp bool, name string, qType uint16) (uint16, [][]byte, [][]byte) {
+		return 2, nil, nil // SERVFAIL
+	})
+	defer f.close()
+
+	r := newDNSResolver(f.address())
+	_, _, err := r.lookupSRVTTL(context.Background(), "_http._tcp.example.net")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+		t.Error("Expected a temporary DNSError, not", err)
+	}
+
+	silent, _ := net.ListenPacket("udp", "127.0.0.1:0") // Never responds
+	defer silent.Close()
+	r = newDNSResolver(silent.LocalAddr().String())
+	r.timeout = time.Second / 4
+	_, _, err = r.lookupSRVTTL(context.Background(), "_http._tcp.example.net")
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTimeout {
+		t.Error("Expected a timeout DNSError, not", err)
+	}
+
+	good := newFakeDNS(t, func(tcp bool, name string, qType uint16) (uint16, [][]byte, [][]byte) {
+		return 0, [][]byte{fakeSRV(42, 1, 10, 8080, "s1.example.net")}, nil
+	})
+	defer good.close()
+	r = newDNSResolver(silent.LocalAddr().String() + ", " + good.address())
+	r.timeout = time.Second / 4
+	srvs, _, err := r.lookupSRVTTL(context.Background(), "_http._tcp.example.net")
+	if err != nil || len(srvs) != 1 {
+		t.Error("Expected second server to answer", srvs, err)
+	}
+}
+
+func TestResolverServers(t *testing.T) {
+	r := newDNSResolver("127.0.0.1, [::1], 192.0.2.1:5353,")
+	if len(r.servers) != 3 || r.servers[0] != "127.0.0.1:53" || r.servers[1] != "[::1]:53" ||
+		r.servers[2] != "192.0.2.1:5353" {
+		t.Error("Servers not parsed correctly", r.servers)
+	}
+}
+
+func TestResolverUnpackName(t *testing.T) {
+	msg := make([]byte, dnsHeaderLen)
+	msg, _ = packName(msg, "example.net")
+	msg = append(msg, 3, 'w', 'w', 'w', 0xC0, dnsHeaderLen) // www + pointer to example.net
+	name, next, err := unpackName(msg, dnsHeaderLen+13)
+	if err != nil || name != "www.example.net" || next != len(msg) {
+		t.Error("Compressed name not unpacked correctly", name, next, err)
+	}
+
+	loop := append(make([]byte, dnsHeaderLen), 0xC0, dnsHeaderLen) // Points to itself
+	_, _, err = unpackName(loop, dnsHeaderLen)
+	if err == nil {
+		t.Error("Expected pointer loop to be detected")
+	}
+
+	_, _, err = unpackName([]byte{5, 'a', 'b'}, 0)
+	if err == nil {
+		t.Error("Expected short message to be detected")
+	}
+}
+
+// Test that lookupSRV uses the DNS TTL rather than the configured TTL
+func TestResolverLookupSRVTTL(t *testing.T) {
+	f := newFakeDNS(t, func(tcp bool, name string, qType uint16) (uint16, [][]byte, [][]byte) {
+		switch name {
+		case "_http._tcp.example.net":
+			return 0, [][]byte{fakeSRV(42, 1, 10, 8080, "s1.example.net")}, nil
+		case "_http._tcp.zero.example.net":
+			return 0, [][]byte{fakeSRV(0, 1, 10, 8080, "s1.example.net")}, nil
+		}
+		return dnsRcodeNXDomain, nil, [][]byte{fakeSOA(300, 90)}
+	})
+	defer f.close()
+
+	cslb := newCslbWithOptions(Options{DNSServers: f.address(), DisableHealthChecks: true})
+	now := time.Now()
+	cesrv := cslb.lookupSRV(context.Background(), now, "http", "tcp", "example.net")
+	if cesrv.uniqueTargets() != 1 || cesrv.expires != now.Add(42*time.Second) {
+		t.Error("Expected one target expiring in 42s", cesrv)
+	}
+	cesrv = cslb.lookupSRV(context.Background(), now, "https", "tcp", "example.net")
+	if cesrv.uniqueTargets() != 0 || cesrv.expires != now.Add(90*time.Second) {
+		t.Error("Expected NXDomain expiring in 90s", cesrv)
+	}
+	cesrv = cslb.lookupSRV(context.Background(), now, "http", "tcp", "zero.example.net")
+	if cesrv.expires != now.Add(lowerDNSTTLLimit) {
+		t.Error("Expected zero TTL to be clamped to the lower limit, not the default", cesrv.expires.Sub(now))
+	}
+	if dnsTTL(noDNSTTL, time.Minute) != time.Minute {
+		t.Error("Expected the default when there is no DNS TTL")
+	}
+}
+
+// Test that a response is only accepted if it matches the ID and question of the query
+func TestResolverMismatch(t *testing.T) {
+	query, _ := packQuery(1234, "_http._tcp.example.net", dnsTypeSRV)
+	response := func(id uint16, name string, qType uint16) []byte {
+		resp, _ := packQuery(id, name, qType)
+		binary.BigEndian.PutUint16(resp[2:], 0x8180)
+		binary.BigEndian.PutUint16(resp[10:], 0) // No OPT RR
+		return resp
+	}
+
+	if _, err := unpackAnswer(response(1234, "_HTTP._tcp.Example.net", dnsTypeSRV), query); err != nil {
+		t.Error("Expected matching response to be accepted", err)
+	}
+	if _, err := unpackAnswer(response(4321, "_http._tcp.example.net", dnsTypeSRV), query); err == nil {
+		t.Error("Expected ID mismatch to be rejected")
+	}
+	if _, err := unpackAnswer(response(1234, "_http._tcp.example.org", dnsTypeSRV), query); err == nil {
+		t.Error("Expected name mismatch to be rejected")
+	}
+	if _, err := unpackAnswer(response(1234, "_http._tcp.example.net", dnsTypeTXT), query); err == nil {
+		t.Error("Expected type mismatch to be rejected")
+	}
+}
+
+func TestResolverURI(t *testing.T) {
+	f := newFakeDNS(t, func(tcp bool, name string, qType uint16) (uint16, [][]byte, [][]byte) {
+		if name != "_80._cslb.s1.example.net" || qType != dnsTypeURI {
+			return dnsRcodeNXDomain, nil, [][]byte{fakeSOA(300, 60)}
+		}
+		return 0, [][]byte{fakeURI(120, 1, 10, "http://s1.example.net/hc"),
+			fakeURI(30, 2, 0, "https://s1.example.net/hc")}, nil
+	})
+	defer f.close()
+
+	r := newDNSResolver(f.address())
+	uris, ttl, err := r.lookupURITTL(context.Background(), "_80._cslb.s1.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 30*time.Second {
+		t.Error("Expected smallest TTL of 30s, not", ttl)
+	}
+	if len(uris) != 2 || uris[0].Priority != 1 || uris[0].Weight != 10 ||
+		uris[0].Target != "http://s1.example.net/hc" || uris[1].Target != "https://s1.example.net/hc" {
+		t.Error("URIs not parsed correctly", uris)
+	}
+
+	_, _, err = r.lookupURITTL(context.Background(), "_80._cslb.s2.example.net")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Error("Expected IsNotFound DNSError, not", err)
+	}
+}
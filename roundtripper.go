@@ -0,0 +1,69 @@
+package cslb
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// serviceContextKey is the context.Value key used to pass an explicit SRV service name from a
+// RoundTripper (or an application) down to dialContext.
+type serviceContextKey struct{}
+
+// WithService returns a copy of the context which instructs cslb to use "service" as the SRV
+// service name when dialing with this context, e.g. WithService(ctx, "https") causes a dial to
+// "example.net:8443" to look up _https._tcp.example.net rather than deducing the service from the
+// port. An empty service is ignored.
+func WithService(ctx context.Context, service string) context.Context {
+	if len(service) == 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, serviceContextKey{}, strings.ToLower(service))
+}
+
+// serviceFromContext returns the service set by WithService, if any.
+func serviceFromContext(ctx context.Context) (string, bool) {
+	service, ok := ctx.Value(serviceContextKey{}).(string)
+
+	return service, ok && len(service) > 0
+}
+
+// RoundTripper is an http.RoundTripper which wraps a cslb-enabled http.Transport. Its sole purpose
+// is to make the request URL scheme visible to cslb so that the SRV service name is derived from
+// the scheme rather than guessed from the port. E.g. "https://api.example.net:8443/" results in a
+// lookup of _https._tcp.api.example.net instead of _8443._tcp.api.example.net.
+//
+// If the request context already carries a service set by WithService that service is used in
+// preference to the scheme.
+//
+// Note that http.Transport pools connections by scheme, host and port so a connection established
+// for one explicit service may be re-used by a request to the same address with a different
+// explicit service.
+type RoundTripper struct {
+	Transport *http.Transport
+}
+
+// NewRoundTripper enables the http.Transport for cslb processing and returns a RoundTripper which
+// wraps it, thus:
+//
+//	client := &http.Client{Transport: cslb.NewRoundTripper(&http.Transport{})}
+func NewRoundTripper(ht *http.Transport) *RoundTripper {
+	return &RoundTripper{Transport: Enable(ht)}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if _, ok := serviceFromContext(ctx); !ok && req.URL != nil && len(req.URL.Scheme) > 0 {
+		req = req.WithContext(WithService(ctx, req.URL.Scheme))
+	}
+
+	return t.Transport.RoundTrip(req)
+}
+
+// CloseIdleConnections closes any idle connections in the wrapped http.Transport. It exists so that
+// http.Client.CloseIdleConnections works with a RoundTripper.
+func (t *RoundTripper) CloseIdleConnections() {
+	t.Transport.CloseIdleConnections()
+}
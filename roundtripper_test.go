@@ -0,0 +1,52 @@
+package cslb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Test that the RoundTripper passes the URL scheme down to dialContext so the SRV service name
+// comes from the scheme rather than the port.
+func TestRoundTripperScheme(t *testing.T) {
+	cslb := realInit()
+	mr := newMockResolver()
+	mr.appendSRV("https", "tcp", "api.example.net", "realtarget", 9443, 1, 1)
+	cslb.netResolver = mr
+	dialer := newMockDialer()
+	dialer.err = fmt.Errorf("RoundTripper mock error") // No need to go any further than the dial
+
+	rt := NewRoundTripper(&http.Transport{DialContext: dialer.dialContext})
+	defer Disable(rt.Transport)
+	client := &http.Client{Transport: rt}
+
+	client.Get("https://api.example.net:8443/")
+	if mr.lastSRV != "_https._tcp.api.example.net" {
+		t.Error("RoundTripper should have caused an _https lookup, not", mr.lastSRV)
+	}
+	if dialer.address() != "realtarget:9443" {
+		t.Error("RoundTripper should have dialed the SRV target, not", dialer.address())
+	}
+
+	// An explicit service in the request context takes precedence over the scheme
+
+	req, _ := http.NewRequest("GET", "http://api.example.net:8080/", nil)
+	req = req.WithContext(WithService(context.Background(), "xmpp-client"))
+	client.Do(req)
+	if mr.lastSRV != "_xmpp-client._tcp.api.example.net" {
+		t.Error("Explicit service should have been used for lookup, not", mr.lastSRV)
+	}
+}
+
+// Test that WithService ignores empty services and lowercases the rest.
+func TestRoundTripperWithService(t *testing.T) {
+	ctx := WithService(context.Background(), "")
+	if _, ok := serviceFromContext(ctx); ok {
+		t.Error("Empty service should not have been set")
+	}
+	ctx = WithService(context.Background(), "HTTPS")
+	if s, _ := serviceFromContext(ctx); s != "https" {
+		t.Error("Service should have been lowercased, not", s)
+	}
+}
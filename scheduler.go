@@ -0,0 +1,175 @@
+package cslb
+
+/*
+The hcScheduler runs all health checks from a single dispatcher go-routine and a bounded pool of
+worker go-routines. Each target has an hcTask which sits in a heap ordered by when it is next due.
+The dispatcher hands due tasks to the workers, and the worker which runs the task either
+re-schedules it or drops it once the target has expired from the healthStore.
+
+The number of workers is the global limit on concurrent health checks. If all workers are busy, due
+tasks simply wait a little longer. Intervals are jittered by the caller so that targets added at
+the same time do not remain synchronized.
+*/
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// hcTask is the health check state of one target which is carried between runs
+type hcTask struct {
+	key           string    // healthStoreKey of the target
+	ceh           *ceHealth // The target being checked
+	spec          *hcSpec   // nil until the TXT RR has been fetched
+	urlExpires    time.Time // When to re-fetch the TXT RR - IsZero() means never
+	next          time.Time // When this task is next due to run
+	fetchFailures int       // Consecutive failures to fetch the spec on the first run
+	index         int       // Maintained by heap.Interface
+}
+
+// hcQueue implements heap.Interface ordered by hcTask.next
+type hcQueue []*hcTask
+
+func (t hcQueue) Len() int           { return len(t) }
+func (t hcQueue) Less(i, j int) bool { return t[i].next.Before(t[j].next) }
+func (t hcQueue) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+	t[i].index = i
+	t[j].index = j
+}
+
+func (t *hcQueue) Push(x interface{}) {
+	task := x.(*hcTask)
+	task.index = len(*t)
+	*t = append(*t, task)
+}
+
+func (t *hcQueue) Pop() interface{} {
+	old := *t
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	*t = old[:n-1]
+
+	return task
+}
+
+// hcRunFunc runs the task once and returns true if the task should be re-scheduled at task.next
+type hcRunFunc func(ctx context.Context, task *hcTask) bool
+
+type hcScheduler struct {
+	sync.Mutex                    // Protects queue
+	queue      hcQueue            // Tasks waiting to run
+	wake       chan struct{}      // Tells the dispatcher the head of the queue may have changed
+	ctx        context.Context    // Cancelled by stop()
+	cancel     context.CancelFunc //
+	wg         sync.WaitGroup     // Tracks the dispatcher and workers
+}
+
+func newHCScheduler() *hcScheduler {
+	t := &hcScheduler{wake: make(chan struct{}, 1)}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+
+	return t
+}
+
+// start starts the dispatcher and workers. Tasks scheduled prior to start are retained and run once
+// started.
+func (t *hcScheduler) start(workers int, run hcRunFunc) {
+	work := make(chan *hcTask)
+	t.wg.Add(workers + 1)
+	go t.dispatcher(work)
+	for ix := 0; ix < workers; ix++ {
+		go t.worker(work, run)
+	}
+}
+
+// stop cancels any in-progress health checks and waits for the dispatcher and workers to exit.
+func (t *hcScheduler) stop() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// schedule adds the task to the queue to run at task.next
+func (t *hcScheduler) schedule(task *hcTask) {
+	t.Lock()
+	heap.Push(&t.queue, task)
+	t.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default: // Dispatcher has already been told
+	}
+}
+
+// len returns the number of tasks waiting to run
+func (t *hcScheduler) len() int {
+	t.Lock()
+	defer t.Unlock()
+
+	return len(t.queue)
+}
+
+// dispatcher hands each task to a worker when it is due. It sleeps until the earliest task is due
+// or until a new task is scheduled.
+func (t *hcScheduler) dispatcher(work chan *hcTask) {
+	defer t.wg.Done()
+
+	for {
+		t.Lock()
+		for len(t.queue) > 0 && !t.queue[0].next.After(time.Now()) {
+			task := heap.Pop(&t.queue).(*hcTask)
+			t.Unlock() // Don't hold the lock while waiting for a free worker
+			select {
+			case work <- task:
+			case <-t.ctx.Done():
+				return
+			}
+			t.Lock()
+		}
+		wait := time.Hour // Nothing to do - wait for a schedule()
+		if len(t.queue) > 0 {
+			wait = time.Until(t.queue[0].next)
+		}
+		t.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			return
+		case <-t.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (t *hcScheduler) worker(work chan *hcTask, run hcRunFunc) {
+	defer t.wg.Done()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case task := <-work:
+			if run(t.ctx, task) {
+				t.schedule(task)
+			}
+		}
+	}
+}
+
+// jitter returns the duration randomly adjusted by up to +/-10% so that targets do not all get
+// checked at the same instant.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 5)
+	if spread <= 0 {
+		return d
+	}
+
+	return d - d/10 + time.Duration(rand.Int63n(spread))
+}
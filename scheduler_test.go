@@ -0,0 +1,119 @@
+package cslb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that the scheduler runs tasks in order of next and never exceeds the worker limit
+func TestSchedulerWorkers(t *testing.T) {
+	s := newHCScheduler()
+	var mu sync.Mutex
+	var running, maxRunning int
+	var order []string
+	done := make(chan struct{})
+	run := func(ctx context.Context, task *hcTask) bool {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		order = append(order, task.key)
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond * 50)
+
+		mu.Lock()
+		running--
+		if len(order) == 6 && running == 0 {
+			close(done)
+		}
+		mu.Unlock()
+
+		return false
+	}
+
+	now := time.Now()
+	for ix, key := range []string{"f", "e", "d", "c", "b", "a"} { // Scheduled in reverse order
+		s.schedule(&hcTask{key: key, next: now.Add(-time.Duration(ix) * time.Second)})
+	}
+	if s.len() != 6 {
+		t.Error("Expected six tasks queued prior to start, not", s.len())
+	}
+	s.start(2, run)
+	defer s.stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for tasks to run")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxRunning != 2 {
+		t.Error("Expected a maximum of two concurrent tasks, not", maxRunning)
+	}
+	first := map[string]bool{order[0]: true, order[1]: true} // Two workers race to append
+	if !first["a"] || !first["b"] {
+		t.Error("Expected earliest tasks to run first", order)
+	}
+	if s.len() != 0 {
+		t.Error("Dropped tasks should not be re-scheduled", s.len())
+	}
+}
+
+// Test that a re-scheduled task is run again and that stop cancels a running task
+func TestSchedulerStop(t *testing.T) {
+	s := newHCScheduler()
+	runs := make(chan int, 10)
+	count := 0
+	s.start(1, func(ctx context.Context, task *hcTask) bool {
+		count++
+		runs <- count
+		if count < 3 {
+			task.next = time.Now().Add(time.Millisecond * 10)
+			return true
+		}
+		<-ctx.Done() // Block until stop()
+
+		return false
+	})
+	s.schedule(&hcTask{key: "a", next: time.Now()})
+
+	for want := 1; want <= 3; want++ {
+		select {
+		case got := <-runs:
+			if got != want {
+				t.Error("Expected run", want, "got", got)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for run", want)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("stop() did not return")
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	for ix := 0; ix < 1000; ix++ {
+		d := jitter(time.Second * 10)
+		if d < time.Second*9 || d > time.Second*11 {
+			t.Fatal("Jitter outside +/-10%", d)
+		}
+	}
+	if jitter(0) != 0 {
+		t.Error("Expected zero duration to remain zero")
+	}
+}
@@ -0,0 +1,350 @@
+package cslb
+
+/*
+Selectors replace the RFC2782 weighted random selection of bestTarget() with an alternative
+algorithm. bestTarget() still walks the SRV priorities in order and still vetoes targets which are
+not isGood() so a Selector only ever chooses between the healthy targets of a single priority. If
+no priority has a healthy target, bestTarget() falls back to the least-worst target regardless of
+any Selector.
+
+A Selector is set for all SRVs with Options.Selector (or "cslb_selector") and for individual SRVs
+with SetSelector(). The operator of an SRV can also signal a built-in Selector by encoding it in the
+SRV weights. See cePriority.decodeAlgorithm().
+
+A single Selector is shared by many SRVs and many go-routines so the built-in Selectors keep any
+state per SRV name and protect it with a mutex. State for SRVs which are no longer selected from is
+periodically discarded, as is state for targets which are no longer candidates.
+
+The built-in Selectors take their randomness from an injectable function, in the same way as
+bestTarget(), so that tests can make their results deterministic.
+*/
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Selector chooses one of the candidate targets of an SRV. Candidates are the healthy targets of
+// the highest priority with any healthy targets, in SRV order. There is always at least one
+// candidate. Select returns the index of the chosen candidate and must be safe for concurrent use.
+type Selector interface {
+	Select(srvName string, candidates []Candidate) int
+}
+
+// Candidate describes a target offered to a Selector.
+type Candidate struct {
+	Target      string
+	Port        int
+	Priority    int
+	Weight      int           // Relative weight including any health check bias. Always > 0.
+	Outstanding int           // Open connections plus dials in progress to this target
+	Latency     time.Duration // Smoothed round trip time of dials to this target. Zero if unknown.
+}
+
+// key returns the healthStore key of the candidate
+func (t *Candidate) key() string {
+	return makeHealthStoreKey(t.Target, t.Port)
+}
+
+// Names of the built-in Selectors as accepted by NewSelector() and "cslb_selector"
+const (
+	SelectorRandom        = "random"    // RFC2782 weighted random - the default
+	SelectorRoundRobin    = "rr"        // Each candidate in turn, ignoring weight
+	SelectorWeightedRR    = "wrr"       // Smooth weighted round-robin as popularized by nginx
+	SelectorLeastConns    = "leastconn" // Fewest open connections
+	SelectorLowestLatency = "latency"   // Lowest smoothed dial latency
+	SelectorPowerOfTwo    = "p2c"       // Fewest outstanding of two weighted random choices
+)
+
+// NewSelector returns a new instance of the named built-in Selector.
+func NewSelector(name string) (Selector, error) {
+	return newSelector(name, rand.Intn)
+}
+
+// newSelector is NewSelector with the random function made explicit.
+func newSelector(name string, randIntn func(int) int) (Selector, error) {
+	switch strings.ToLower(name) {
+	case SelectorRandom:
+		return &randomSelector{randIntn: randIntn}, nil
+	case SelectorRoundRobin:
+		return &roundRobinSelector{state: newSelectorState()}, nil
+	case SelectorWeightedRR:
+		return &weightedRRSelector{state: newSelectorState()}, nil
+	case SelectorLeastConns:
+		return &leastConnsSelector{randIntn: randIntn}, nil
+	case SelectorLowestLatency:
+		return &lowestLatencySelector{randIntn: randIntn}, nil
+	case SelectorPowerOfTwo:
+		return &powerOfTwoSelector{randIntn: randIntn}, nil
+	}
+
+	return nil, fmt.Errorf("cslb: Unknown Selector '%s'", name)
+}
+
+// SetSelector sets the Selector used by the package-level cslb instance for the SRV name, e.g.
+// "_https._tcp.example.net". A nil Selector removes the setting so that Options.Selector applies.
+func SetSelector(srvName string, s Selector) {
+	getCSLB().setSelector(srvName, s)
+}
+
+func (t *cslb) setSelector(srvName string, s Selector) {
+	srvName = strings.TrimSuffix(strings.ToLower(srvName), ".") // Same form as the srvStore key
+
+	t.selectorsMu.Lock()
+	defer t.selectorsMu.Unlock()
+
+	if s == nil {
+		delete(t.selectors, srvName)
+	} else {
+		t.selectors[srvName] = s
+	}
+}
+
+// selector returns the Selector for the SRV name and the algorithm signalled in the SRV weights or
+// nil if the RFC2782 selection applies. A Selector set for the SRV by the application takes
+// precedence over a signalled algorithm which in turn takes precedence over Options.Selector.
+func (t *cslb) selector(srvName, algorithm string) Selector {
+	t.selectorsMu.RLock()
+	s := t.selectors[srvName]
+	t.selectorsMu.RUnlock()
+	if s != nil {
+		return s
+	}
+	if s = t.signalledSelectors[algorithm]; s != nil {
+		return s
+	}
+
+	return t.Selector
+}
+
+// weightedRandom returns the index of a candidate selected randomly in proportion to its weight.
+func weightedRandom(candidates []Candidate, randIntn func(int) int) int {
+	total := 0
+	for _, c := range candidates {
+		total += c.Weight
+	}
+	r := randIntn(total)
+	for ix, c := range candidates {
+		r -= c.Weight
+		if r < 0 {
+			return ix
+		}
+	}
+
+	return len(candidates) - 1 // Not reached
+}
+
+// randomSelector is the RFC2782 weighted random selection. It differs from the default in
+// bestTarget() only in that an unhealthy target is never considered, so the remaining weights
+// determine the selection rather than the first healthy target taking up the slack.
+type randomSelector struct {
+	randIntn func(int) int
+}
+
+func (t *randomSelector) String() string { return SelectorRandom }
+
+func (t *randomSelector) Select(srvName string, candidates []Candidate) int {
+	return weightedRandom(candidates, t.randIntn)
+}
+
+// selectorStateTTL is how long the state of an SRV is kept after it was last selected from
+const selectorStateTTL = time.Minute * 10
+
+// selectorState holds the per-SRV state of the stateful Selectors. It is protected by the mutex
+// of the Selector which owns it.
+type selectorState struct {
+	srvs      map[string]*srvSelectorState // Keyed by SRV name
+	lastSweep time.Time
+}
+
+type srvSelectorState struct {
+	next     int            // roundRobinSelector
+	current  map[string]int // weightedRRSelector - keyed by candidate key
+	lastUsed time.Time
+}
+
+func newSelectorState() *selectorState {
+	return &selectorState{srvs: make(map[string]*srvSelectorState), lastSweep: time.Now()}
+}
+
+// get returns the state for the SRV, creating it if need be. Every selectorStateTTL, the state of
+// any SRV which hasn't been selected from since the previous sweep is discarded.
+func (t *selectorState) get(srvName string) *srvSelectorState {
+	now := time.Now()
+	if now.Sub(t.lastSweep) > selectorStateTTL {
+		for name, s := range t.srvs {
+			if now.Sub(s.lastUsed) > selectorStateTTL {
+				delete(t.srvs, name)
+			}
+		}
+		t.lastSweep = now
+	}
+	s := t.srvs[srvName]
+	if s == nil {
+		s = &srvSelectorState{current: make(map[string]int)}
+		t.srvs[srvName] = s
+	}
+	s.lastUsed = now
+
+	return s
+}
+
+type roundRobinSelector struct {
+	sync.Mutex
+	state *selectorState
+}
+
+func (t *roundRobinSelector) String() string { return SelectorRoundRobin }
+
+func (t *roundRobinSelector) Select(srvName string, candidates []Candidate) int {
+	t.Lock()
+	defer t.Unlock()
+
+	s := t.state.get(srvName)
+	ix := s.next % len(candidates) // The candidate list shrinks when targets go bad
+	s.next = ix + 1
+
+	return ix
+}
+
+// weightedRRSelector is the smooth weighted round-robin used by nginx. Each selection adds the
+// weight of every candidate to its current value, picks the largest and subtracts the total weight
+// from the one picked. This spreads the selection of a heavy target across the cycle rather than
+// picking it many times in a row.
+//
+// The current values of targets which are no longer candidates are discarded so that a target
+// which returns starts afresh rather than with a stale credit or debt.
+type weightedRRSelector struct {
+	sync.Mutex
+	state *selectorState
+}
+
+func (t *weightedRRSelector) String() string { return SelectorWeightedRR }
+
+func (t *weightedRRSelector) Select(srvName string, candidates []Candidate) int {
+	t.Lock()
+	defer t.Unlock()
+
+	s := t.state.get(srvName)
+	current := make(map[string]int, len(candidates)) // Only carry forward current candidates
+	best := 0
+	total := 0
+	for ix := range candidates {
+		key := candidates[ix].key()
+		current[key] = s.current[key] + candidates[ix].Weight
+		total += candidates[ix].Weight
+		if current[key] > current[candidates[best].key()] {
+			best = ix
+		}
+	}
+	current[candidates[best].key()] -= total
+	s.current = current
+
+	return best
+}
+
+// leastConnsSelector picks the candidate with the fewest outstanding connections relative to its
+// weight. Ties are broken by weighted random selection.
+type leastConnsSelector struct {
+	randIntn func(int) int
+}
+
+func (t *leastConnsSelector) String() string { return SelectorLeastConns }
+
+func (t *leastConnsSelector) Select(srvName string, candidates []Candidate) int {
+	var ties []int
+	for ix := range candidates {
+		if len(ties) == 0 {
+			ties = append(ties, ix)
+			continue
+		}
+		switch compareLoad(&candidates[ix], &candidates[ties[0]]) {
+		case -1:
+			ties = append(ties[:0], ix)
+		case 0:
+			ties = append(ties, ix)
+		}
+	}
+	if len(ties) == 1 {
+		return ties[0]
+	}
+	tied := make([]Candidate, len(ties))
+	for ix, cix := range ties {
+		tied[ix] = candidates[cix]
+	}
+
+	return ties[weightedRandom(tied, t.randIntn)]
+}
+
+// compareLoad compares the outstanding connections per unit of weight of the two candidates
+// without resorting to floating point. Returns -1, 0 or +1 as a is less, equal or more loaded.
+func compareLoad(a, b *Candidate) int {
+	left := a.Outstanding * b.Weight
+	right := b.Outstanding * a.Weight
+	switch {
+	case left < right:
+		return -1
+	case left > right:
+		return 1
+	}
+
+	return 0
+}
+
+// lowestLatencySelector picks the candidate with the lowest latency. Candidates with an unknown
+// latency are picked first, by weight, so that every candidate gets measured.
+type lowestLatencySelector struct {
+	randIntn func(int) int
+}
+
+func (t *lowestLatencySelector) String() string { return SelectorLowestLatency }
+
+func (t *lowestLatencySelector) Select(srvName string, candidates []Candidate) int {
+	var unknown []Candidate
+	var unknownIx []int
+	best := -1
+	for ix, c := range candidates {
+		if c.Latency == 0 {
+			unknown = append(unknown, c)
+			unknownIx = append(unknownIx, ix)
+			continue
+		}
+		if best == -1 || c.Latency < candidates[best].Latency {
+			best = ix
+		}
+	}
+	if len(unknown) > 0 {
+		return unknownIx[weightedRandom(unknown, t.randIntn)]
+	}
+
+	return best
+}
+
+// powerOfTwoSelector picks two candidates by weighted random selection and chooses the one with the
+// fewest outstanding connections relative to its weight. This avoids the herd behaviour of
+// leastconn when many clients see the same idle target.
+type powerOfTwoSelector struct {
+	randIntn func(int) int
+}
+
+func (t *powerOfTwoSelector) String() string { return SelectorPowerOfTwo }
+
+func (t *powerOfTwoSelector) Select(srvName string, candidates []Candidate) int {
+	if len(candidates) == 1 {
+		return 0
+	}
+	first := weightedRandom(candidates, t.randIntn)
+	rest := append(append([]Candidate{}, candidates[:first]...), candidates[first+1:]...)
+	second := weightedRandom(rest, t.randIntn)
+	if second >= first { // Convert back to an index of candidates
+		second++
+	}
+	if compareLoad(&candidates[second], &candidates[first]) < 0 {
+		return second
+	}
+
+	return first
+}
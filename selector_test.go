@@ -0,0 +1,209 @@
+package cslb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestSelector(t *testing.T, name string) Selector {
+	s, err := NewSelector(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestSelectorBuiltins(t *testing.T) {
+	if _, err := NewSelector("bogus"); err == nil {
+		t.Error("Expected an error for an unknown Selector")
+	}
+
+	three := []Candidate{{Target: "a", Weight: 5}, {Target: "b", Weight: 1}, {Target: "c", Weight: 1}}
+
+	rr := newTestSelector(t, SelectorRoundRobin)
+	for ix := 0; ix < 6; ix++ {
+		if got := rr.Select("srv", three); got != ix%3 {
+			t.Error("Round-robin", ix, "expected", ix%3, "got", got)
+		}
+	}
+	if got := rr.Select("other", three); got != 0 {
+		t.Error("Round-robin state should be per SRV name", got)
+	}
+
+	wrr := newTestSelector(t, SelectorWeightedRR)
+	var seq string
+	for ix := 0; ix < 7; ix++ {
+		seq += three[wrr.Select("srv", three)].Target
+	}
+	if seq != "aabacaa" {
+		t.Error("Smooth weighted round-robin sequence wrong", seq)
+	}
+
+	lc := newTestSelector(t, SelectorLeastConns)
+	if got := lc.Select("srv", []Candidate{{Outstanding: 2, Weight: 1}, {Outstanding: 0, Weight: 1},
+		{Outstanding: 1, Weight: 1}}); got != 1 {
+		t.Error("Least connections should pick the idle target, not", got)
+	}
+	if got := lc.Select("srv", []Candidate{{Outstanding: 1, Weight: 1}, {Outstanding: 2, Weight: 4}}); got != 1 {
+		t.Error("Least connections should be relative to weight, not", got)
+	}
+
+	lat := newTestSelector(t, SelectorLowestLatency)
+	if got := lat.Select("srv", []Candidate{{Latency: time.Millisecond * 3, Weight: 1},
+		{Latency: time.Millisecond, Weight: 1}, {Latency: time.Millisecond * 2, Weight: 1}}); got != 1 {
+		t.Error("Lowest latency should pick the fastest target, not", got)
+	}
+	if got := lat.Select("srv", []Candidate{{Latency: time.Millisecond, Weight: 1}, {Weight: 1}}); got != 1 {
+		t.Error("Lowest latency should measure unknown targets first, not", got)
+	}
+
+	p2c := newTestSelector(t, SelectorPowerOfTwo)
+	for ix := 0; ix < 20; ix++ {
+		if got := p2c.Select("srv", []Candidate{{Outstanding: 3, Weight: 1}, {Outstanding: 1, Weight: 1}}); got != 1 {
+			t.Fatal("Power of two should pick the less loaded of two, not", got)
+		}
+	}
+	if got := p2c.Select("srv", three[:1]); got != 0 {
+		t.Error("Power of two with one candidate should pick it, not", got)
+	}
+
+	random := newTestSelector(t, SelectorRandom)
+	for ix := 0; ix < 20; ix++ {
+		if got := random.Select("srv", []Candidate{{Weight: 1}, {Weight: 1}}); got < 0 || got > 1 {
+			t.Fatal("Random returned an out of range index", got)
+		}
+	}
+}
+
+// Test that bestTarget honors priorities and health vetoes when a Selector is in effect
+func TestSelectorBestTarget(t *testing.T) {
+	cslb := realInit()
+	cslb.netResolver = makeMockResolver()
+	cslb.DisableHealthChecks = true
+	cslb.setSelector("_HTTPS._udp.example.com.", newTestSelector(t, SelectorRoundRobin))
+
+	now := time.Now()
+	cesrv := cslb.lookupSRV(context.Background(), now, "https", "udp", "example.com")
+	var got []string
+	for ix := 0; ix < 7; ix++ {
+		got = append(got, cslb.bestTarget(cesrv).Target)
+	}
+	if fmt.Sprint(got) != "[u1.example.com u2.example.com u3.example.com u4.example.com u5.example.com "+
+		"u6.example.com u1.example.com]" {
+		t.Error("Expected round-robin over the highest priority", got)
+	}
+
+	// Veto all but u2 of the highest priority
+
+	future := now.Add(time.Hour)
+	for _, target := range []string{"u1", "u3", "u4", "u5", "u6"} {
+		port := 1444
+		if target == "u1" {
+			port = 1443
+		}
+		cslb.setDialResult(future, target+".example.com", port, fmt.Errorf("refused"))
+	}
+	for ix := 0; ix < 3; ix++ {
+		if srv := cslb.bestTarget(cesrv); srv.Target != "u2.example.com" {
+			t.Error("Expected the only healthy target, not", srv.Target)
+		}
+	}
+
+	cslb.setDialResult(future, "u2.example.com", 1444, fmt.Errorf("refused"))
+	if srv := cslb.bestTarget(cesrv); srv.Target != "u7.example.com" || srv.Priority != 14 {
+		t.Error("Expected lower priority target, not", srv)
+	}
+
+	cslb.setDialResult(future.Add(time.Minute), "u7.example.com", 1444, fmt.Errorf("refused"))
+	if srv := cslb.bestTarget(cesrv); srv.Target == "u7.example.com" {
+		t.Error("Expected a least-worst target with the soonest nextDialAttempt, not", srv)
+	}
+
+	cslb.setSelector("_https._udp.example.com", nil)
+	if cslb.selector(cesrv.name, "") != nil {
+		t.Error("Expected Selector to be removed")
+	}
+	cslb.Selector = newTestSelector(t, SelectorLeastConns)
+	if cslb.selector(cesrv.name, "") != cslb.Selector {
+		t.Error("Expected global Selector to apply")
+	}
+}
+
+// Test that dialing tracks outstanding dials and latency
+func TestSelectorDialTracking(t *testing.T) {
+	cslb := realInit()
+	cslb.DisableHealthChecks = true
+	cslb.populateHealthStore(time.Now(), "", []string{"s1.example.net:80"})
+
+	cslb.beginDial("s1.example.net", 80)
+	cslb.beginDial("s1.example.net", 80)
+	ceh := cslb.healthStore.cache["s1.example.net:80"]
+	if ceh.dialing != 2 {
+		t.Error("Expected two dials in progress, not", ceh.dialing)
+	}
+	cslb.endDial("s1.example.net", 80, time.Millisecond*5, nil)
+	cslb.endDial("s1.example.net", 80, time.Second, fmt.Errorf("refused"))
+	if ceh.dialing != 0 || ceh.rtt != time.Millisecond*5 {
+		t.Error("Expected no dials in progress and RTT of the good dial", ceh.dialing, ceh.rtt)
+	}
+	cslb.endDial("s1.example.net", 80, time.Millisecond, nil)
+	if ceh.dialing != 0 {
+		t.Error("Unmatched endDial should not go negative", ceh.dialing)
+	}
+}
+
+// Test that the built-in Selectors use the supplied random function so results are deterministic
+func TestSelectorRandIntn(t *testing.T) {
+	last := func(n int) int { return n - 1 }
+	three := []Candidate{{Target: "a", Weight: 5}, {Target: "b", Weight: 1}, {Target: "c", Weight: 1}}
+	for _, name := range []string{SelectorRandom, SelectorLeastConns, SelectorLowestLatency} {
+		s, err := newSelector(name, last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ix := 0; ix < 5; ix++ {
+			if got := s.Select("srv", three); got != 2 {
+				t.Error(name, "should pick the last candidate with a fixed rand, not", got)
+			}
+		}
+	}
+
+	// Selectors used for DNS-signalled algorithms should use the injectable cslb.randIntn
+
+	cslb := realInit()
+	cslb.randIntn = func(n int) int { return 0 }
+	for ix := 0; ix < 5; ix++ {
+		if got := cslb.signalledSelectors[SelectorLeastConns].Select("srv", three); got != 0 {
+			t.Error("Signalled Selector should use cslb.randIntn, not", got)
+		}
+	}
+}
+
+// Test that state for departed targets and idle SRVs is discarded
+func TestSelectorStatePrune(t *testing.T) {
+	wrr := newTestSelector(t, SelectorWeightedRR).(*weightedRRSelector)
+	three := []Candidate{{Target: "a", Weight: 5}, {Target: "b", Weight: 1}, {Target: "c", Weight: 1}}
+	for ix := 0; ix < 3; ix++ {
+		wrr.Select("srv", three)
+	}
+	wrr.Select("srv", three[:2])
+	if current := wrr.state.srvs["srv"].current; len(current) != 2 {
+		t.Error("Expected state for departed target to be dropped", current)
+	}
+
+	rr := newTestSelector(t, SelectorRoundRobin).(*roundRobinSelector)
+	rr.Select("old", three)
+	rr.Select("new", three)
+	rr.state.srvs["old"].lastUsed = time.Now().Add(-selectorStateTTL * 2)
+	rr.state.lastSweep = time.Now().Add(-selectorStateTTL * 2)
+	rr.Select("new", three)
+	if _, ok := rr.state.srvs["old"]; ok {
+		t.Error("Expected idle SRV state to be swept")
+	}
+	if s := rr.state.srvs["new"]; s == nil || s.next != 2 {
+		t.Error("Expected active SRV state to be retained", s)
+	}
+}
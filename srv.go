@@ -9,11 +9,13 @@ all targets with that priority.
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,23 +24,70 @@ const (
 )
 
 type srvCache struct {
-	sync.RWMutex                   // Protects everything within this struct
-	done         chan bool         // Shuts down the cache cleaner
-	cache        map[string]*ceSRV // The cache key is ToLower(qName).
+	sync.RWMutex                       // Protects everything within this struct
+	done         chan bool             // Shuts down the cache cleaner
+	cache        map[string]*ceSRV     // The cache key is ToLower(qName).
+	inflight     map[string]*srvFlight // DNS lookups currently in progress - same key as cache
+}
+
+// srvFlight is a single DNS lookup shared by all go-routines which miss the cache for the same key
+// at the same time. The done channel is closed once cesrv is set and inserted into the cache.
+//
+// A flight started by refreshSRVs has refresh set along with the lookups of the entry being
+// refreshed so that they can be carried forward to the new entry.
+type srvFlight struct {
+	done    chan struct{}
+	cesrv   *ceSRV
+	refresh bool
+	lookups int64
+}
+
+// srvDNSStatus classifies the outcome of the DNS lookup which created the ceSRV
+type srvDNSStatus int
+
+const (
+	srvFound     srvDNSStatus = iota // Answer had SRV RRs
+	srvNotFound                      // NXDomain or no SRV RRs
+	srvTransient                     // Timeout, SERVFAIL or similar - answered from previous entry if any
+)
+
+func (t srvDNSStatus) String() string {
+	switch t {
+	case srvFound:
+		return "Found"
+	case srvNotFound:
+		return "NXDomain"
+	case srvTransient:
+		return "Transient"
+	}
+
+	return "?"
 }
 
 type ceSRV struct {
+	name              string        // srvStore key - used to find any per-SRV Selector
 	expires           time.Time     // When this entry expire out of the cache
-	lookups           int           // Includes initial lookup that creates the cache entry
+	dnsStatus         srvDNSStatus  // Classification of the DNS lookup
+	dnsError          string        // Error from the DNS lookup if dnsStatus is srvTransient
+	staleUntil        time.Time     // Targets may be served stale until then - IsZero() if no targets
+	stale             bool          // Targets are from a previous entry as DNS lookups are failing
+	lookups           int64         // Includes initial lookup that creates the cache entry - use atomic
+	refreshLookups    int64         // Value of lookups when this entry was created by a refresh
 	priorities        []*cePriority // Slice of targets with equal priority
 	uniqueTargetCount int           // Count of all unique targets (host:port)
 }
 
 // String return a printable string of the cached Entry SRV
 func (t *ceSRV) String() (s string) {
-	s = fmt.Sprintf("%s (%d):", t.expires, len(t.priorities))
+	s = fmt.Sprintf("%s %s (%d):", t.expires, t.dnsStatus, len(t.priorities))
+	if t.stale {
+		s += " stale"
+	}
 	for _, cep := range t.priorities {
 		s += fmt.Sprintf("\n\tp=%d totw=%d (%d):", cep.priority, cep.totalWeight, len(cep.targets))
+		if len(cep.algorithm) > 0 {
+			s += " alg=" + cep.algorithm
+		}
 		for _, cet := range cep.targets {
 			s += fmt.Sprintf("\n\t\ttarw=%d %s:%d", cet.weight, cet.target, cet.port)
 		}
@@ -50,6 +99,7 @@ type cePriority struct {
 	priority    int
 	totalWeight int         // Sum of all weights - used as an upper limit for the PRNG
 	targets     []*ceTarget // Slice of all targets within priority
+	algorithm   string      // Selector name signalled in the SRV weights - empty if none
 }
 
 type ceTarget struct {
@@ -64,7 +114,8 @@ func (t *ceTarget) healthStoreKey() string {
 }
 
 func newSrvCache() *srvCache {
-	return &srvCache{cache: make(map[string]*ceSRV), done: make(chan bool)}
+	return &srvCache{cache: make(map[string]*ceSRV), inflight: make(map[string]*srvFlight),
+		done: make(chan bool)}
 }
 
 func (t *srvCache) start(cacheInterval time.Duration) {
@@ -76,8 +127,9 @@ func (t *srvCache) stop() {
 }
 
 // lookupSRV looks up the SRV RR for the domain. First it tries looking in the cache and if not
-// there, the DNS is consulted. The qName is of the form ToLower(_http._tcp.$domain) where "http" is
-// the service and "tcp" is the proto. The cache is updated with the results of the DNS lookup.
+// there (or expired but not yet cleaned), the DNS is consulted. The qName is of the form
+// ToLower(_http._tcp.$domain) where "http" is the service and "tcp" is the proto. The cache is
+// updated with the results of the DNS lookup.
 //
 // lookupSRV returns a *ceSRV with an array of (possibly zero) net.SRV RRs even with an NXDomain
 // response (which comes back as an error). An empty list means the DNS lookup failed; normally this
@@ -87,43 +139,206 @@ func (t *srvCache) stop() {
 // qName for the cache lookup. I suppose we could have a different cache key and let LookupSRV do
 // it's thing but that would be a little confusing. Besides, the SRV name construction is well-known
 // and simple.
+//
+// Concurrent cache misses for the same key are coalesced so that only one DNS lookup is in flight
+// per key. Every caller waits for that lookup to complete or for their own context to be done,
+// whichever comes first. A caller whose context is done before the lookup completes gets an empty
+// ceSRV which is not cached.
 func (t *cslb) lookupSRV(ctx context.Context, now time.Time, service, proto, domain string) *ceSRV {
 	key := strings.ToLower("_" + service + "._" + proto + "." + domain) // rfc2782 format
 	t.srvStore.RLock()
 	cesrv := t.srvStore.cache[key]
-	if cesrv != nil { // If cache entry exists we're done
-		cesrv.lookups++
+	if cesrv != nil && !cesrv.expires.Before(now) { // If a current cache entry exists we're done
+		atomic.AddInt64(&cesrv.lookups, 1)
 		t.srvStore.RUnlock()
 		return cesrv
 	}
-	t.srvStore.RUnlock() // Don't hold mutex across a possible DNS lookup
+	t.srvStore.RUnlock()
 
-	cesrv = &ceSRV{expires: now.Add(t.NotFoundSRVTTL), lookups: 1} // Assume NXDomain
-	_, srvList, _ := t.netResolver.LookupSRV(ctx, "", "", key)
-	if len(srvList) > 0 { // Found something so transfer to the new ceSRV
-		cesrv.expires = now.Add(t.FoundSRVTTL)
-		cesrv.populate(srvList)
+	var ls cslbStats
+	defer t.addStats(&ls)
+
+	t.srvStore.Lock()
+	cesrv = t.srvStore.cache[key] // Check again as another go-routine may have just inserted it
+	if cesrv != nil && !cesrv.expires.Before(now) {
+		atomic.AddInt64(&cesrv.lookups, 1)
+		t.srvStore.Unlock()
+		return cesrv
+	}
+	flight := t.srvStore.inflight[key]
+	if flight == nil { // First in so start the lookup
+		flight = &srvFlight{done: make(chan struct{})}
+		t.srvStore.inflight[key] = flight
+		go t.resolveFlight(now, key, flight)
+	} else {
+		ls.CoalescedSRV++
 	}
+	t.srvStore.Unlock() // Don't hold mutex across a possible DNS lookup
+
+	select {
+	case <-flight.done:
+		atomic.AddInt64(&flight.cesrv.lookups, 1)
+		return flight.cesrv
+	case <-ctx.Done():
+		return &ceSRV{expires: now, dnsStatus: srvTransient} // No targets so caller reverts
+	}
+}
 
-	// Insert/over-write the cache entry. It's possible another go-routine snuck in while we
-	// were off in DNS-land and created an entry with the same key. Oh well. The slowest
-	// go-routine wins. We don't bother queuing all callers for the same cache key behind each
-	// other and let one do the resolution. I suppose we could at some point in the future by
-	// creating a sync.Cond and the resolving go-routine could Broadcast when done. Go makes
-	// this quite easy but that's bound to be a premature optimization as a single program is
-	// unlikely to be banging away at a single domain at the same instant in time without an
-	// entry existing in our cache.
+// resolveFlight runs the DNS lookup on behalf of all go-routines waiting on the flight, inserts the
+// result into the cache then releases the waiters. It is run as a separate go-routine with its own
+// context so that the lookup completes for the remaining waiters even if the go-routine which
+// started it gives up.
+func (t *cslb) resolveFlight(now time.Time, key string, flight *srvFlight) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.InterceptTimeout)
+	defer cancel()
 
-	targetKeys := cesrv.uniqueTargetKeys()
-	cesrv.uniqueTargetCount = len(targetKeys)
+	cesrv := t.resolveSRV(ctx, now, key)
 	t.srvStore.Lock()
+	if flight.refresh {
+		lookups := flight.lookups
+		if old := t.srvStore.cache[key]; old != nil { // Carry forward any lookups made while
+			lookups = atomic.LoadInt64(&old.lookups) // we were off resolving.
+		}
+		cesrv.lookups = lookups
+		cesrv.refreshLookups = lookups
+	}
 	t.srvStore.cache[key] = cesrv // cesrv is now read-only for the rest of its life
+	delete(t.srvStore.inflight, key)
 	t.srvStore.Unlock()
-	t.populateHealthStore(now, targetKeys)
+	t.populateHealthStore(now, key, cesrv.uniqueTargetKeys())
+	if flight.refresh {
+		t.addStats(&cslbStats{SRVRefreshes: 1})
+		if t.PrintSRVLookup {
+			fmt.Println("cslb.refreshSRVs:", key, cesrv.uniqueTargets(), cesrv)
+		}
+	}
+
+	flight.cesrv = cesrv
+	close(flight.done)
+}
+
+// serviceFromSRVKey returns the service name from an SRV cache key, e.g. "http" from
+// "_http._tcp.example.net".
+func serviceFromSRVKey(key string) string {
+	if dot := strings.IndexByte(key, '.'); dot > 1 && key[0] == '_' {
+		return key[1:dot]
+	}
+
+	return ""
+}
+
+// resolveSRV queries the DNS for the SRV qName and returns a new ceSRV ready for insertion into the
+// cache. The returned ceSRV has zero lookups.
+//
+// DNS errors are classified so that a transient failure such as a resolver timeout or SERVFAIL
+// does not take the domain out of cslb control for the full NotFoundSRVTTL. A transient failure is
+// only cached for TransientSRVTTL and if the previous cache entry had targets, those targets
+// continue to be used in the meantime.
+//
+// In the style of RFC8767 the targets of a found SRV continue to be served, flagged as stale, for
+// up to SRVStaleLimit past their expiry while DNS lookups keep failing. A found SRV is retained in
+// the cache for that long for exactly this purpose.
+func (t *cslb) resolveSRV(ctx context.Context, now time.Time, key string) *ceSRV {
+	var srvList []*net.SRV
+	ttl := noDNSTTL
+	var err error
+	if tr, ok := t.netResolver.(ttlResolver); ok { // Prefer a resolver which gives us real TTLs
+		srvList, ttl, err = tr.lookupSRVTTL(ctx, key)
+	} else {
+		_, srvList, err = t.netResolver.LookupSRV(ctx, "", "", key)
+	}
+
+	cesrv := &ceSRV{name: key}
+	switch {
+	case len(srvList) > 0: // Found something so transfer to the new ceSRV
+		cesrv.dnsStatus = srvFound
+		cesrv.expires = now.Add(dnsTTL(ttl, t.FoundSRVTTL))
+		cesrv.staleUntil = cesrv.expires.Add(t.SRVStaleLimit)
+		cesrv.populate(srvList)
+
+	case err == nil || isNotFound(err): // An empty answer is as good as an NXDomain
+		cesrv.dnsStatus = srvNotFound
+		cesrv.expires = now.Add(dnsTTL(ttl, t.NotFoundSRVTTL))
+
+	default:
+		t.addStats(&cslbStats{TransientSRV: 1})
+		cesrv.dnsStatus = srvTransient
+		cesrv.dnsError = err.Error()
+		cesrv.expires = now.Add(t.TransientSRVTTL)
+		t.srvStore.RLock()
+		prev := t.srvStore.cache[key]
+		t.srvStore.RUnlock()
+		if prev != nil && len(prev.priorities) > 0 && now.Before(prev.staleUntil) {
+			t.addStats(&cslbStats{StaleSRV: 1}) // Answer from the previous entry
+			cesrv.priorities = prev.priorities
+			cesrv.staleUntil = prev.staleUntil
+			cesrv.stale = true
+			if cesrv.staleUntil.Before(cesrv.expires) { // Never serve stale beyond the limit
+				cesrv.expires = cesrv.staleUntil
+			}
+		}
+	}
+	cesrv.uniqueTargetCount = len(cesrv.uniqueTargetKeys())
 
 	return cesrv
 }
 
+// isNotFound returns true if the error is a definitive DNS response that the name does not exist
+// or has no SRV RRs. Any other error is considered transient.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// refreshSRVs re-queries the DNS for each active SRV which is about to expire and swaps the new
+// ceSRV into the cache so that application requests never wait on DNS for a busy SRV. An active
+// SRV is one which has had lookups since it was last created or refreshed. The refreshed entry
+// carries forward the lookup count so the status page continues to show total lookups.
+//
+// Each refresh runs concurrently as an srvFlight so that one slow or unresponsive name doesn't hold
+// up the refresh of any other name. Running as a flight also means that an application request
+// which misses the cache while the refresh is under way waits on the refresh rather than starting
+// a second lookup. A name which already has a flight is skipped. The started flights are returned
+// so that callers (well, tests) can wait for them.
+func (t *cslb) refreshSRVs(now time.Time) (flights []*srvFlight) {
+	refreshAt := now.Add(t.SRVRefreshAhead)
+	t.srvStore.Lock()
+	defer t.srvStore.Unlock()
+
+	for key, cesrv := range t.srvStore.cache {
+		lookups := atomic.LoadInt64(&cesrv.lookups)
+		if lookups <= cesrv.refreshLookups || !cesrv.expires.Before(refreshAt) || cesrv.expires.Before(now) {
+			continue
+		}
+		if t.srvStore.inflight[key] != nil {
+			continue
+		}
+		flight := &srvFlight{done: make(chan struct{}), refresh: true, lookups: lookups}
+		t.srvStore.inflight[key] = flight
+		flights = append(flights, flight)
+		go t.resolveFlight(time.Now(), key, flight)
+	}
+
+	return
+}
+
+// refresher periodically calls refreshSRVs until the srvStore is stopped. Normally run as a
+// go-routine.
+func (t *cslb) refresher(refreshInterval time.Duration) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.srvStore.done:
+			return
+		case now := <-ticker.C:
+			t.refreshSRVs(now)
+		}
+	}
+}
+
 // populate transfers the SRV RRs into the ceSRV. This means sorting the SRVs by priority order and
 // also calculating total weight so we can conveniently apply the SRV selection algorithm.
 //
@@ -151,6 +366,10 @@ func (t *ceSRV) populate(srvs []*net.SRV) {
 		cep.totalWeight += cet.weight
 	}
 
+	for _, cep := range t.priorities {
+		cep.decodeAlgorithm()
+	}
+
 	// Assign a non-zero weight to targets with an SRV weight of zero
 
 	for _, cep := range t.priorities {
@@ -179,6 +398,57 @@ func (t *ceSRV) populate(srvs []*net.SRV) {
 	}
 }
 
+// The SRV weight may signal the Selector an operator wants used. The weight is encoded as:
+//
+//	weight<<8 | 0x1F<<3 | algorithm
+//
+// so that implementations which don't understand the encoding still distribute in roughly the
+// same ratios as the original weights. See "SELECTION ALGORITHMS" in doc.go.
+const (
+	weightSignalMask    = 0xF8 // Bits 3-7 of the SRV weight
+	weightSignal        = 0xF8 // are all ones to signal an encoded weight
+	weightAlgorithmMask = 0x07 // Bits 0-2 are the algorithm
+)
+
+// encodedAlgorithms maps the algorithm bits of an encoded weight to the name of a built-in
+// Selector. Values 0-2 are as originally published in the cslb TODO list so that zones already
+// built to that sketch get the algorithm they expect. Unassigned values still have their weights
+// decoded but the selection is left to whatever Selector would otherwise apply.
+var encodedAlgorithms = [weightAlgorithmMask + 1]string{
+	0: SelectorRoundRobin,
+	1: SelectorLowestLatency,
+	2: SelectorLeastConns,
+	3: SelectorWeightedRR,
+	4: SelectorPowerOfTwo,
+}
+
+// decodeAlgorithm replaces the weights of the priority with the decoded weights if *every* target
+// in the priority has an encoded weight signalling the same algorithm. Otherwise the weights are
+// left alone as a partially encoded priority is more likely to be an accident than a signal.
+func (t *cePriority) decodeAlgorithm() {
+	algorithm := -1
+	for _, cet := range t.targets {
+		weight := cet.weight / smallChanceMultiplier
+		if weight&weightSignalMask != weightSignal {
+			return
+		}
+		if algorithm >= 0 && weight&weightAlgorithmMask != algorithm {
+			return
+		}
+		algorithm = weight & weightAlgorithmMask
+	}
+	if algorithm < 0 {
+		return
+	}
+
+	t.totalWeight = 0
+	for _, cet := range t.targets {
+		cet.weight = (cet.weight / smallChanceMultiplier >> 8) * smallChanceMultiplier
+		t.totalWeight += cet.weight
+	}
+	t.algorithm = encodedAlgorithms[algorithm]
+}
+
 // bestTarget selects the "best" target to try and connect to based on the SRV selection algorithm
 // and the health of the targets. That is, pick the SRV set with the lowest-numerical priority
 // first. If all those targets are unavailable then pick the SRV set with the next lowest-numerical
@@ -201,6 +471,9 @@ func (t *ceSRV) populate(srvs []*net.SRV) {
 // - Same thing for each Priority down if none of the previous priorities are in good health
 // - Target with soonest next connection attempt regardless of priority or weight - least worst
 //
+// If a Selector applies to a priority, it replaces the first two choices within that priority. See
+// selectTarget.
+//
 // The caller should always check for a nil return, the other values in the returned SRV are mostly
 // returned as a convenience to the caller. They should not presume they are the exact same values
 // as retrieved from the DNS but they will be comparable.
@@ -217,15 +490,41 @@ func (t *cslb) bestTarget(cesrv *ceSRV) (srv *net.SRV) {
 	// Search for the in-range weight but also note a target in good health in passing (called
 	// our secondChoice) as the preferred weight may be in bad health in which case we'll take
 	// any weight in the same priority as our second choice in preference to a lower priority.
+	//
+	// The SRV weight of each target may be biased by the results of its health check so the
+	// total weight of the priority is re-calculated on each call. Should no target have a bias
+	// the total is the same as cePriority.totalWeight. With PreferLowLatency the weights are
+	// further biased toward the targets with the lowest RTT.
 
 	haveSecondChoice := false
 	for _, cep := range cesrv.priorities {
-		wix := t.randIntn(cep.totalWeight) // Select the weight value using a "cheap" RNG
+		if sel := t.selector(cesrv.name, cep.algorithm); sel != nil { // Alternative algorithm?
+			if t.selectTarget(sel, now, cesrv.name, cep, srv) {
+				return
+			}
+			continue // No healthy targets in this priority
+		}
+		cehs := make([]*ceHealth, len(cep.targets))
+		weights := make([]int, len(cep.targets))
+		rtts := make([]time.Duration, len(cep.targets))
+		totalWeight := 0
+		for ix, cet := range cep.targets {
+			cehs[ix] = t.healthStore.cache[cet.healthStoreKey()]
+			weights[ix] = cehs[ix].effectiveWeight(cet.weight)
+			totalWeight += weights[ix]
+			if cehs[ix] != nil {
+				rtts[ix] = cehs[ix].rtt
+			}
+		}
+		if t.PreferLowLatency {
+			totalWeight = biasWeightsByRTT(weights, rtts)
+		}
+		wix := t.randIntn(totalWeight) // Select the weight value using a "cheap" RNG
 		lower := 0
 		upper := 0
-		for _, cet := range cep.targets {
-			ceh := t.healthStore.cache[cet.healthStoreKey()]
-			upper += cet.weight
+		for ix, cet := range cep.targets {
+			ceh := cehs[ix]
+			upper += weights[ix]
 			if ceh == nil || ceh.isGood(now) {
 				if wix >= lower && wix < upper { // Is this target in the weight range?
 					srv.Target = cet.target
@@ -249,14 +548,19 @@ func (t *cslb) bestTarget(cesrv *ceSRV) (srv *net.SRV) {
 		}
 	}
 
-	// Didn't find *any* healthy targets so search over *all* targets for least-worst. We don't
-	// expect this to occur very often so the search loop is run a second time rather than add
-	// complexity to the relatively simple search loop above. The least-worst target has the
-	// soonest nextDialAttempt. Priority and weight are ignored as there is no point in
-	// considering a higher priority target which has a nextDialAttempt way off into the future
-	// as that means it's *just* failed whereas one that's a millisecond away from now has had
-	// the longest time period to "come good".
+	t.leastWorstTarget(now, cesrv, srv)
 
+	return
+}
+
+// leastWorstTarget is used when bestTarget didn't find *any* healthy targets so it searches over
+// *all* targets for least-worst. We don't expect this to occur very often so the search loop is run
+// a second time rather than add complexity to the relatively simple search loop in bestTarget. The
+// least-worst target has the soonest nextDialAttempt. Priority and weight are ignored as there is
+// no point in considering a higher priority target which has a nextDialAttempt way off into the
+// future as that means it's *just* failed whereas one that's a millisecond away from now has had
+// the longest time period to "come good". Caller must hold the healthStore lock.
+func (t *cslb) leastWorstTarget(now time.Time, cesrv *ceSRV, srv *net.SRV) {
 	var smallestLeastWorst time.Time
 	for _, cep := range cesrv.priorities {
 		for _, cet := range cep.targets {
@@ -279,10 +583,75 @@ func (t *cslb) bestTarget(cesrv *ceSRV) (srv *net.SRV) {
 			}
 		}
 	}
+}
+
+// biasWeightsByRTT scales each weight by the ratio of the lowest RTT to the RTT of the target so
+// that, within a priority, a target with twice the RTT of the fastest target gets half its weight.
+// Targets with an unknown RTT are not penalized so that they get measured. Returns the new total.
+func biasWeightsByRTT(weights []int, rtts []time.Duration) (total int) {
+	var lowest time.Duration
+	for _, rtt := range rtts {
+		if rtt > 0 && (lowest == 0 || rtt < lowest) {
+			lowest = rtt
+		}
+	}
+	for ix := range weights {
+		if lowest > 0 && rtts[ix] > 0 {
+			weights[ix] = int(int64(weights[ix]) * int64(lowest) / int64(rtts[ix]))
+			if weights[ix] == 0 {
+				weights[ix] = 1
+			}
+		}
+		total += weights[ix]
+	}
 
 	return
 }
 
+// selectTarget offers the healthy targets of the priority to the Selector. Returns false if there
+// are no healthy targets. Caller must hold the healthStore lock.
+func (t *cslb) selectTarget(sel Selector, now time.Time, srvName string, cep *cePriority, srv *net.SRV) bool {
+	var candidates []Candidate
+	for _, cet := range cep.targets {
+		ceh := t.healthStore.cache[cet.healthStoreKey()]
+		if ceh != nil && !ceh.isGood(now) {
+			continue
+		}
+		c := Candidate{Target: cet.target, Port: cet.port, Priority: cep.priority,
+			Weight: ceh.effectiveWeight(cet.weight)}
+		if ceh != nil {
+			c.Outstanding = ceh.dialing + ceh.conns.openConns()
+			c.Latency = ceh.rtt
+		}
+		candidates = append(candidates, c)
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+	if t.PreferLowLatency {
+		weights := make([]int, len(candidates))
+		rtts := make([]time.Duration, len(candidates))
+		for ix := range candidates {
+			weights[ix], rtts[ix] = candidates[ix].Weight, candidates[ix].Latency
+		}
+		biasWeightsByRTT(weights, rtts)
+		for ix := range candidates {
+			candidates[ix].Weight = weights[ix]
+		}
+	}
+
+	ix := sel.Select(srvName, candidates)
+	if ix < 0 || ix >= len(candidates) { // Defend against a misbehaving Selector
+		ix = 0
+	}
+	srv.Target = candidates[ix].Target
+	srv.Port = uint16(candidates[ix].Port)
+	srv.Priority = uint16(cep.priority)
+	srv.Weight = uint16(candidates[ix].Weight / smallChanceMultiplier)
+
+	return true
+}
+
 // uniqueTargetKeys returns a slice of all unique targets keys in the SRV (a key is host:port). The
 // SRV might actually have more targets than this count if some of the targets are identical. This
 // shouldn't occur in a single well-constructed SRV arrangement but targets might be shared across
@@ -324,12 +693,14 @@ func (t *srvCache) cleaner(cleanInterval time.Duration) {
 	}
 }
 
+// clean deletes expired entries. Entries with targets are retained until their stale limit has
+// passed so that resolveSRV has them available to serve stale.
 func (t *srvCache) clean(now time.Time) {
 	t.Lock()
 	defer t.Unlock()
 
 	for key, cesrv := range t.cache {
-		if cesrv.expires.Before(now) {
+		if cesrv.expires.Before(now) && !now.Before(cesrv.staleUntil) {
 			delete(t.cache, key)
 		}
 	}
@@ -340,7 +711,10 @@ type ceSrvAsStats struct {
 	CName       string
 	Expires     string
 	Lookups     string
+	DNSStatus   string // Found, NXDomain or Transient plus any error
+	IsStale     bool   // Targets are being served past their expiry
 	Priority    int
+	Algorithm   string // Selector signalled in the SRV weights
 	Weight      int
 	Port        int
 	Target      string
@@ -365,24 +739,32 @@ func (t *srvCache) getStats(hc *healthCache) *srvStats {
 	s.Srvs = make([]ceSrvAsStats, 0, len(t.cache)*4)    // Just guesses, but better than nothing and
 	s.nxDomains = make([]ceSrvAsStats, 0, len(t.cache)) // over-sized is probably better than under-sized.
 	for cname, cesrv := range t.cache {
-		if len(cesrv.priorities) == 0 { // NXDomain?
+		dnsStatus := cesrv.dnsStatus.String()
+		if len(cesrv.dnsError) > 0 {
+			dnsStatus += ": " + trimTo(cesrv.dnsError, 60)
+		}
+		if len(cesrv.priorities) == 0 { // NXDomain or Transient with no previous targets?
 			s.nxDomains = append(s.nxDomains,
 				ceSrvAsStats{CName: cname,
-					Expires: cesrv.expires.Sub(now).Truncate(time.Second).String(),
-					Lookups: fmt.Sprintf("%d", cesrv.lookups),
-					Target:  "**NXDomain**"})
+					Expires:   cesrv.expires.Sub(now).Truncate(time.Second).String(),
+					Lookups:   fmt.Sprintf("%d", atomic.LoadInt64(&cesrv.lookups)),
+					DNSStatus: dnsStatus,
+					Target:    "**" + cesrv.dnsStatus.String() + "**"})
 			continue
 		}
 		for _, cep := range cesrv.priorities {
 			for _, cet := range cep.targets {
 				entry := ceSrvAsStats{CName: cname,
-					Expires:  cesrv.expires.Sub(now).Truncate(time.Second).String(),
-					Lookups:  fmt.Sprintf("%d", cesrv.lookups),
-					Priority: cep.priority,
-					Weight:   cet.weight,
-					Port:     cet.port,
-					Target:   cet.target,
-					IsGood:   true}
+					Expires:   cesrv.expires.Sub(now).Truncate(time.Second).String(),
+					Lookups:   fmt.Sprintf("%d", atomic.LoadInt64(&cesrv.lookups)),
+					DNSStatus: dnsStatus,
+					IsStale:   cesrv.stale,
+					Priority:  cep.priority,
+					Algorithm: cep.algorithm,
+					Weight:    cet.weight,
+					Port:      cet.port,
+					Target:    cet.target,
+					IsGood:    true}
 				hc.RLock()
 				ceh := hc.cache[cet.healthStoreKey()]
 				if ceh != nil {
@@ -14,12 +14,19 @@ type mockResolver struct {
 	mu      sync.Mutex // So go test -race doesn't complain
 	srvs    map[string][]*net.SRV
 	txts    map[string][]string
+	uris    map[string][]*dnsURI
 	lastSRV string
 	lastTXT string
+
+	srvLookups int           // Count of calls to LookupSRV
+	srvDelay   time.Duration // Delay before LookupSRV returns
+	srvErr     error         // If set, LookupSRV returns this error regardless of qName
+	txtErr     error         // If set, LookupTXT returns this error regardless of qName
 }
 
 func newMockResolver() *mockResolver {
-	return &mockResolver{srvs: make(map[string][]*net.SRV), txts: make(map[string][]string)}
+	return &mockResolver{srvs: make(map[string][]*net.SRV), txts: make(map[string][]string),
+		uris: make(map[string][]*dnsURI)}
 }
 
 // append the target to the srv. Last append is always at the end to tests can rely on position.
@@ -44,6 +51,12 @@ func (t *mockResolver) appendSRV(service, proto, name string, target string, por
 }
 
 func (t *mockResolver) LookupSRV(ctx context.Context, service, proto, name string) (cname string, srvs []*net.SRV, err error) {
+	t.mu.Lock()
+	delay := t.srvDelay
+	t.srvLookups++
+	t.mu.Unlock()
+	time.Sleep(delay) // Simulate DNS latency without holding the mutex
+
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -53,9 +66,13 @@ func (t *mockResolver) LookupSRV(ctx context.Context, service, proto, name strin
 	}
 	qName += name
 	t.lastSRV = qName
+	if t.srvErr != nil {
+		err = t.srvErr
+		return
+	}
 	srvs, ok := t.srvs[qName]
 	if !ok {
-		err = fmt.Errorf("mock LookupSRV not found for %s", qName)
+		err = &net.DNSError{Name: qName, Err: "mock LookupSRV not found", IsNotFound: true}
 		return
 	}
 	cname = qName
@@ -76,8 +93,32 @@ func (t *mockResolver) LookupTXT(ctx context.Context, qName string) (txts []stri
 
 	txts, ok := t.txts[qName]
 	t.lastTXT = qName
+	if t.txtErr != nil {
+		return nil, t.txtErr
+	}
 	if !ok {
-		err = fmt.Errorf("mock LookupTXT not found for %s", qName)
+		err = &net.DNSError{Name: qName, Err: "mock LookupTXT not found", IsNotFound: true}
+	}
+
+	return
+}
+
+func (t *mockResolver) appendURI(qName string, priority, weight int, target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.uris[qName] = append(t.uris[qName], &dnsURI{Priority: uint16(priority), Weight: uint16(weight), Target: target})
+}
+
+// lookupURITTL implements uriResolver. The TTL is always noDNSTTL so the default applies.
+func (t *mockResolver) lookupURITTL(ctx context.Context, qName string) (uris []*dnsURI, ttl time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ttl = noDNSTTL
+	uris, ok := t.uris[qName]
+	if !ok {
+		err = &net.DNSError{Name: qName, Err: "mock lookupURITTL not found", IsNotFound: true}
 	}
 
 	return
@@ -325,3 +366,381 @@ func TestSRVcleaner(t *testing.T) {
 		t.Error("Expected one entry, not", origLen)
 	}
 }
+
+func waitFlights(flights []*srvFlight) {
+	for _, flight := range flights {
+		<-flight.done
+	}
+}
+
+// Test that active SRVs are refreshed ahead of expiry and idle ones are not
+func TestSRVRefresh(t *testing.T) {
+	cslb := realInit()
+	mr := makeMockResolver()
+	cslb.netResolver = mr
+	now := time.Now()
+	soon := now.Add(-cslb.FoundSRVTTL).Add(cslb.SRVRefreshAhead / 2) // Expires within the window
+	getEntry := func() *ceSRV {
+		cslb.srvStore.RLock()
+		defer cslb.srvStore.RUnlock()
+		return cslb.srvStore.cache["_http._tcp.example.net"]
+	}
+
+	orig := cslb.lookupSRV(context.Background(), soon, "http", "tcp", "example.net")
+	cslb.lookupSRV(context.Background(), soon, "http", "tcp", "example.net") // Cache hit
+	mr.appendSRV("http", "tcp", "example.net", "t21.example.net", 4, 13, 95)
+	waitFlights(cslb.refreshSRVs(now))
+	cesrv := getEntry()
+	if cesrv == orig {
+		t.Fatal("Active SRV should have been refreshed")
+	}
+	if cesrv.uniqueTargets() != 21 {
+		t.Error("Refreshed SRV should have the new target", cesrv.uniqueTargets())
+	}
+	if cesrv.lookups != 2 || cesrv.refreshLookups != 2 {
+		t.Error("Refreshed SRV should carry forward lookups", cesrv.lookups, cesrv.refreshLookups)
+	}
+	if cslb.cloneStats().SRVRefreshes != 1 {
+		t.Error("Expected one SRVRefreshes", cslb.cloneStats().SRVRefreshes)
+	}
+
+	// The refreshed entry has had no lookups so it should not be refreshed again even when it
+	// is about to expire.
+
+	later := cesrv.expires.Add(-cslb.SRVRefreshAhead / 2)
+	if flights := cslb.refreshSRVs(later); len(flights) != 0 {
+		t.Error("Idle SRV should not have a refresh flight")
+	}
+	if getEntry() != cesrv {
+		t.Error("Idle SRV should not have been refreshed")
+	}
+	if cslb.cloneStats().SRVRefreshes != 1 {
+		t.Error("Unexpected second refresh", cslb.cloneStats().SRVRefreshes)
+	}
+}
+
+// Test that refreshes run concurrently and coalesce with cache misses for the same SRV
+func TestSRVRefreshConcurrent(t *testing.T) {
+	cslb := realInit()
+	mr := makeMockResolver()
+	cslb.netResolver = mr
+	now := time.Now()
+	soon := now.Add(-cslb.FoundSRVTTL).Add(cslb.SRVRefreshAhead / 2)
+	mr.appendSRV("http", "tcp", "example.com", "t1.example.com", 80, 1, 10)
+	for _, domain := range []string{"example.net", "example.com"} {
+		cslb.lookupSRV(context.Background(), soon, "http", "tcp", domain)
+		cslb.lookupSRV(context.Background(), soon, "http", "tcp", domain) // Make it active
+	}
+
+	mr.mu.Lock()
+	mr.srvDelay = time.Second / 2
+	mr.srvLookups = 0
+	mr.mu.Unlock()
+	start := time.Now()
+	flights := cslb.refreshSRVs(now)
+	if len(flights) != 2 || time.Since(start) > time.Second/4 {
+		t.Fatal("Expected two refreshes started without waiting on DNS", len(flights), time.Since(start))
+	}
+	if len(cslb.refreshSRVs(now)) != 0 {
+		t.Error("Names with a refresh in flight should not be refreshed again")
+	}
+
+	expired := now.Add(cslb.FoundSRVTTL) // Misses the cache so waits on the refresh flight
+	cslb.lookupSRV(context.Background(), expired, "http", "tcp", "example.net")
+	waitFlights(flights)
+	if elapsed := time.Since(start); elapsed > time.Second*3/4 {
+		t.Error("Refreshes should have run concurrently", elapsed)
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if mr.srvLookups != 2 {
+		t.Error("Expected cache miss to coalesce with the refresh", mr.srvLookups)
+	}
+}
+
+// Test that concurrent cache misses for the same SRV result in a single DNS lookup and that callers
+// with a shorter deadline give up without waiting for the lookup.
+func TestSRVCoalesce(t *testing.T) {
+	cslb := realInit()
+	mr := makeMockResolver()
+	mr.srvDelay = time.Second / 2
+	cslb.netResolver = mr
+
+	var wg sync.WaitGroup
+	for ix := 0; ix < 50; ix++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cesrv := cslb.lookupSRV(context.Background(), time.Now(), "http", "tcp", "example.net")
+			if cesrv.uniqueTargets() != 20 {
+				t.Error("Expected 20 targets, got", cesrv.uniqueTargets())
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel()
+	start := time.Now()
+	cesrv := cslb.lookupSRV(ctx, time.Now(), "http", "tcp", "example.net")
+	if time.Since(start) > time.Second/4 {
+		t.Error("Short deadline caller should not have waited for the lookup", time.Since(start))
+	}
+	if cesrv.uniqueTargets() != 0 {
+		t.Error("Short deadline caller should get an empty ceSRV", cesrv)
+	}
+	wg.Wait()
+
+	mr.mu.Lock()
+	lookups := mr.srvLookups
+	mr.mu.Unlock()
+	if lookups != 1 {
+		t.Error("Expected exactly one DNS lookup, not", lookups)
+	}
+	if cslb.cloneStats().CoalescedSRV != 50 {
+		t.Error("Expected 50 coalesced lookups, not", cslb.cloneStats().CoalescedSRV)
+	}
+	cesrv = cslb.lookupSRV(context.Background(), time.Now(), "http", "tcp", "example.net")
+	if cesrv.lookups != 51 {
+		t.Error("Expected 51 lookups of the cache entry, not", cesrv.lookups)
+	}
+}
+
+// Test that transient DNS failures are distinguished from NXDomain and that the previous targets
+// are retained across a transient failure.
+func TestSRVTransient(t *testing.T) {
+	cslb := realInit()
+	mr := makeMockResolver()
+	cslb.netResolver = mr
+	now := time.Now()
+	expired := now.Add(-cslb.FoundSRVTTL - time.Second)
+
+	cesrv := cslb.lookupSRV(context.Background(), now, "http", "tcp", "nxdomain.example.net")
+	if cesrv.dnsStatus != srvNotFound || !cesrv.expires.Equal(now.Add(cslb.NotFoundSRVTTL)) {
+		t.Error("Expected NXDomain with NotFoundSRVTTL", cesrv.dnsStatus, cesrv.expires)
+	}
+
+	mr.srvErr = &net.DNSError{Name: "x", Err: "i/o timeout", IsTimeout: true, IsTemporary: true}
+	cesrv = cslb.lookupSRV(context.Background(), now, "http", "tcp", "timeout.example.net")
+	if cesrv.dnsStatus != srvTransient || !cesrv.expires.Equal(now.Add(cslb.TransientSRVTTL)) {
+		t.Error("Expected Transient with TransientSRVTTL", cesrv.dnsStatus, cesrv.expires)
+	}
+	if cesrv.uniqueTargets() != 0 || len(cesrv.dnsError) == 0 {
+		t.Error("Transient with no previous entry should have no targets and an error", cesrv)
+	}
+
+	mr.srvErr = nil
+	cslb.lookupSRV(context.Background(), expired, "http", "tcp", "example.net") // Already expired
+	mr.srvErr = fmt.Errorf("Not a DNSError so must be transient")
+	cesrv = cslb.lookupSRV(context.Background(), now, "http", "tcp", "example.net")
+	if cesrv.dnsStatus != srvTransient {
+		t.Error("Expected Transient, not", cesrv.dnsStatus)
+	}
+	if cesrv.uniqueTargets() != 20 {
+		t.Error("Transient should have retained previous targets", cesrv.uniqueTargets())
+	}
+	if cslb.cloneStats().TransientSRV != 2 {
+		t.Error("Expected two TransientSRV, not", cslb.cloneStats().TransientSRV)
+	}
+
+	stats := cslb.srvStore.getStats(cslb.healthStore)
+	for _, e := range stats.nxDomains {
+		if e.CName == "_http._tcp.timeout.example.net" && !strings.Contains(e.DNSStatus, "timeout") {
+			t.Error("Expected status page to show the timeout", e.DNSStatus)
+		}
+	}
+}
+
+// Test that an expired SRV is served stale while DNS fails and only until the stale limit
+func TestSRVServeStale(t *testing.T) {
+	cslb := realInit()
+	mr := makeMockResolver()
+	cslb.netResolver = mr
+	now := time.Now()
+	expired := now.Add(-cslb.FoundSRVTTL - time.Second)
+
+	cslb.lookupSRV(context.Background(), expired, "http", "tcp", "example.net")
+	cslb.srvStore.clean(now) // Cleaner must retain the entry for serve-stale
+	cslb.srvStore.RLock()
+	kept := len(cslb.srvStore.cache)
+	cslb.srvStore.RUnlock()
+	if kept != 1 {
+		t.Fatal("Cleaner should have retained the expired found SRV", kept)
+	}
+
+	mr.srvErr = &net.DNSError{Name: "x", Err: "server misbehaving", IsTemporary: true}
+	cesrv := cslb.lookupSRV(context.Background(), now, "http", "tcp", "example.net")
+	if !cesrv.stale || cesrv.uniqueTargets() != 20 {
+		t.Error("Expected stale targets to be served", cesrv.stale, cesrv.uniqueTargets())
+	}
+	stats := cslb.srvStore.getStats(cslb.healthStore)
+	if len(stats.Srvs) == 0 || !stats.Srvs[0].IsStale {
+		t.Error("Expected status page to flag stale targets")
+	}
+	if cslb.cloneStats().StaleSRV != 1 {
+		t.Error("Expected one StaleSRV, not", cslb.cloneStats().StaleSRV)
+	}
+
+	pastLimit := cesrv.staleUntil.Add(time.Second) // Stale limit has passed
+	cesrv = cslb.lookupSRV(context.Background(), pastLimit, "http", "tcp", "example.net")
+	if cesrv.stale || cesrv.uniqueTargets() != 0 {
+		t.Error("Stale targets should not be served past the stale limit", cesrv)
+	}
+
+	mr.srvErr = nil // DNS comes good again
+	cesrv = cslb.lookupSRV(context.Background(), pastLimit.Add(cslb.TransientSRVTTL*2), "http", "tcp", "example.net")
+	if cesrv.stale || cesrv.dnsStatus != srvFound {
+		t.Error("Expected fresh found SRV once DNS answers", cesrv)
+	}
+}
+
+// Test that a health check weight bias shifts the distribution within a priority. u1, u2 and u3
+// have SRV weights of 10, 20 and 30. Biasing u3 down to 1% of its weight should make it the least
+// selected of the three.
+func TestSRVWeightBias(t *testing.T) {
+	cslb := realInit()
+	cslb.netResolver = makeMockResolver()
+	cslb.DisableHealthChecks = true
+
+	cesrv := cslb.lookupSRV(context.Background(), time.Now(), "https", "udp", "example.com")
+	cslb.healthStore.Lock()
+	cslb.healthStore.cache["u3.example.com:1444"].weightBias = 0.01
+	cslb.healthStore.Unlock()
+
+	distrib := make(map[string]int)
+	for ix := 0; ix < 1000; ix++ {
+		srv := cslb.bestTarget(cesrv)
+		distrib[srv.Target]++
+	}
+	u1 := distrib["u1.example.com"]
+	u3 := distrib["u3.example.com"]
+	if !(u1 > u3) {
+		t.Error("Expected biased u3 to be selected less than u1", u1, u3)
+	}
+}
+
+// lastSelector always selects the last candidate
+type lastSelector struct{}
+
+func (t lastSelector) Select(srvName string, candidates []Candidate) int {
+	return len(candidates) - 1
+}
+
+// encodeWeight encodes the weight and algorithm as described in "SELECTION ALGORITHMS" in doc.go
+func encodeWeight(weight, algorithm int) int {
+	return weight<<8 | weightSignal | algorithm
+}
+
+// Test that an algorithm signalled in the SRV weights is decoded per priority
+func TestSRVEncodedWeights(t *testing.T) {
+	mr := newMockResolver()
+	mr.appendSRV("http", "tcp", "example.org", "a1.example.org", 80, 1, encodeWeight(10, 2))
+	mr.appendSRV("http", "tcp", "example.org", "a2.example.org", 80, 1, encodeWeight(15, 2))
+	mr.appendSRV("http", "tcp", "example.org", "a3.example.org", 80, 1, encodeWeight(0, 2))
+	mr.appendSRV("http", "tcp", "example.org", "b1.example.org", 80, 2, encodeWeight(10, 4)) // Mixed
+	mr.appendSRV("http", "tcp", "example.org", "b2.example.org", 80, 2, 10)
+	mr.appendSRV("http", "tcp", "example.org", "c1.example.org", 80, 3, encodeWeight(10, 4)) // Conflicting
+	mr.appendSRV("http", "tcp", "example.org", "c2.example.org", 80, 3, encodeWeight(10, 1))
+	mr.appendSRV("http", "tcp", "example.org", "d1.example.org", 80, 4, encodeWeight(20, 7)) // Unassigned
+	mr.appendSRV("http", "tcp", "example.org", "e1.example.org", 80, 5, encodeWeight(1, 0))
+	mr.appendSRV("http", "tcp", "example.org", "e2.example.org", 80, 5, encodeWeight(1, 0))
+
+	cslb := realInit()
+	cslb.netResolver = mr
+	cslb.DisableHealthChecks = true
+	cesrv := cslb.lookupSRV(context.Background(), time.Now(), "http", "tcp", "example.org")
+	if len(cesrv.priorities) != 5 {
+		t.Fatal("Expected five priorities", cesrv)
+	}
+
+	p1 := cesrv.priorities[0]
+	if p1.algorithm != SelectorLeastConns || p1.targets[0].weight != 10*smallChanceMultiplier ||
+		p1.targets[1].weight != 15*smallChanceMultiplier || p1.targets[2].weight == 0 {
+		t.Error("Priority 1 not decoded", cesrv)
+	}
+	if p1.totalWeight != 25*smallChanceMultiplier+p1.targets[2].weight {
+		t.Error("Priority 1 totalWeight not recalculated", p1.totalWeight)
+	}
+	if p2 := cesrv.priorities[1]; len(p2.algorithm) != 0 || p2.targets[1].weight != 10*smallChanceMultiplier {
+		t.Error("Mixed priority 2 should not be decoded", cesrv)
+	}
+	if p3 := cesrv.priorities[2]; len(p3.algorithm) != 0 ||
+		p3.targets[0].weight != encodeWeight(10, 4)*smallChanceMultiplier {
+		t.Error("Conflicting priority 3 should not be decoded", cesrv)
+	}
+	if p4 := cesrv.priorities[3]; len(p4.algorithm) != 0 || p4.targets[0].weight != 20*smallChanceMultiplier {
+		t.Error("Unassigned algorithm should decode weights only", cesrv)
+	}
+	if p5 := cesrv.priorities[4]; p5.algorithm != SelectorRoundRobin {
+		t.Error("Priority 5 should signal round-robin", cesrv)
+	}
+
+	// Veto priorities 1-4 so that the signalled round-robin of priority 5 applies
+
+	future := time.Now().Add(time.Hour)
+	for _, target := range []string{"a1", "a2", "a3", "b1", "b2", "c1", "c2", "d1"} {
+		cslb.setDialResult(future, target+".example.org", 80, fmt.Errorf("refused"))
+	}
+	first := cslb.bestTarget(cesrv).Target
+	second := cslb.bestTarget(cesrv).Target
+	if first == second || !strings.HasPrefix(first, "e") || !strings.HasPrefix(second, "e") {
+		t.Error("Expected signalled round-robin to alternate", first, second)
+	}
+
+	cslb.setSelector(cesrv.name, lastSelector{})
+	for ix := 0; ix < 3; ix++ {
+		if srv := cslb.bestTarget(cesrv); srv.Target != "e2.example.org" {
+			t.Error("Application Selector should take precedence over signalled algorithm", srv.Target)
+		}
+	}
+}
+
+func TestSRVBiasWeightsByRTT(t *testing.T) {
+	weights := []int{100, 100, 100, 100}
+	rtts := []time.Duration{time.Millisecond * 10, time.Millisecond * 20, 0, time.Second * 100}
+	total := biasWeightsByRTT(weights, rtts)
+	if fmt.Sprint(weights) != "[100 50 100 1]" || total != 251 {
+		t.Error("Unexpected biased weights", weights, total)
+	}
+
+	weights = []int{10, 20}
+	if total := biasWeightsByRTT(weights, make([]time.Duration, 2)); total != 30 || weights[0] != 10 {
+		t.Error("Weights should be unchanged when no RTT is known", weights, total)
+	}
+}
+
+// Test that PreferLowLatency steers bestTarget toward the nearest target of a priority
+func TestSRVPreferLowLatency(t *testing.T) {
+	mr := newMockResolver()
+	mr.appendSRV("http", "tcp", "example.org", "near.example.org", 80, 1, 10)
+	mr.appendSRV("http", "tcp", "example.org", "far.example.org", 80, 1, 10)
+	cslb := realInit()
+	cslb.netResolver = mr
+	cslb.DisableHealthChecks = true
+	cslb.PreferLowLatency = true
+
+	now := time.Now()
+	cesrv := cslb.lookupSRV(context.Background(), now, "http", "tcp", "example.org")
+	cslb.healthStore.cache["near.example.org:80"].rtt = time.Millisecond * 10
+	cslb.healthStore.cache["far.example.org:80"].rtt = time.Millisecond * 100
+
+	near := 0
+	for ix := 0; ix < 1000; ix++ {
+		if cslb.bestTarget(cesrv).Target == "near.example.org" {
+			near++
+		}
+	}
+	if near < 850 { // Expect about 909
+		t.Error("Expected the near target to be strongly preferred", near)
+	}
+
+	cslb.Selector = newTestSelector(t, SelectorWeightedRR)
+	near = 0
+	for ix := 0; ix < 11; ix++ {
+		if cslb.bestTarget(cesrv).Target == "near.example.org" {
+			near++
+		}
+	}
+	if near != 10 {
+		t.Error("Expected biased weights to be offered to the Selector", near)
+	}
+}
@@ -43,16 +43,32 @@ const (
 <tr><th align=left>PrintIntercepts</th><td>Print each domain to Target intercept</td><td align=center>{{.PrintIntercepts}}</td></tr>
 <tr><th align=left>PrintSRVLookup</th><td>Print results of SRV Lookups</td><td align=center>{{.PrintSRVLookup}}</td></tr>
 <tr><th align=left>DisableInterception</th><td>Turn off Interception</td><td align=center>{{.DisableInterception}}</td></tr>
+<tr><th align=left>DisableDefaultTransport</th><td>Do not Enable http.DefaultTransport at init</td><td align=center>{{.DisableDefaultTransport}}</td></tr>
 <tr><th align=left>DisableHealthChecks</th><td>Turn off Health Checks</td><td align=center>{{.DisableHealthChecks}}</td></tr>
 <tr><th align=left>AllowNumericServices</th><td>Allow Numeric Service SRV lookups</td><td align=center>{{.AllowNumericServices}}</td></tr>
+<tr><th align=left>PreferLowLatency</th><td>Bias weights toward low RTT targets</td><td align=center>{{.PreferLowLatency}}</td></tr>
+<tr><th align=left>HealthCheckRTT</th><td>Include health check connect times in target RTT</td><td align=center>{{.HealthCheckRTT}}</td></tr>
 <tr><th align=left>HealthCheckTXTPrefix</th><td>Forms part of TXT qName</td><td>{{.HealthCheckTXTPrefix}}</td></tr>
 <tr><th align=left>HealthCheckContentOk</th><td>strings.Contains in health check body</td><td align=center>"{{.HealthCheckContentOk}}"</td></tr>
 <tr><th align=left>HealthCheckFrequency</th><td>Time between health checks</td><td align=right>{{.HealthCheckFrequency}}</td></tr>
+<tr><th align=left>HealthCheckTimeout</th><td>Maximum duration of a health check</td><td align=right>{{.HealthCheckTimeout}}</td></tr>
+<tr><th align=left>HealthCheckMaxBody</th><td>Maximum health check body read</td><td align=right>{{.HealthCheckMaxBody}}</td></tr>
+<tr><th align=left>HealthCheckMaxIdleConns</th><td>Idle health check connections per host</td><td align=right>{{.HealthCheckMaxIdleConns}}</td></tr>
+<tr><th align=left>HealthCheckIdleTimeout</th><td>Idle health check connection lifetime</td><td align=right>{{.HealthCheckIdleTimeout}}</td></tr>
+<tr><th align=left>HealthCheckRise</th><td>Consecutive good checks to reinstate target</td><td align=right>{{.HealthCheckRise}}</td></tr>
+<tr><th align=left>HealthCheckFall</th><td>Consecutive bad checks to remove target</td><td align=right>{{.HealthCheckFall}}</td></tr>
+<tr><th align=left>HealthCheckWorkers</th><td>Maximum concurrent health checks</td><td align=right>{{.HealthCheckWorkers}}</td></tr>
 <tr><th align=left>InterceptTimeout</th><td>Maximum time to try targets</td><td align=right>{{.InterceptTimeout}}</td></tr>
-<tr><th align=left>DialVetoDuration</th><td>Ignore downed targets for this duration</td><td align=right>{{.DialVetoDuration}}</td></tr>
+<tr><th align=left>DialVetoDuration</th><td>Minimum veto of downed targets</td><td align=right>{{.DialVetoDuration}}</td></tr>
+<tr><th align=left>DialVetoMaxDuration</th><td>Maximum veto of repeatedly downed targets</td><td align=right>{{.DialVetoMaxDuration}}</td></tr>
+<tr><th align=left>SRVRefreshAhead</th><td>Re-fetch active SRVs before expiry</td><td align=right>{{.SRVRefreshAhead}}</td></tr>
 <tr><th align=left>NotFoundSRVTTL</th><td>Cache lifetime for SRV NXDomain</td><td align=right>{{.NotFoundSRVTTL}}</td></tr>
+<tr><th align=left>TransientSRVTTL</th><td>Cache lifetime for SRV DNS failure</td><td align=right>{{.TransientSRVTTL}}</td></tr>
+<tr><th align=left>SRVStaleLimit</th><td>Serve expired SRV targets while DNS fails</td><td align=right>{{.SRVStaleLimit}}</td></tr>
 <tr><th align=left>FoundSRVTTL</th><td>Cache lifetime for SRV found</td><td align=right>{{.FoundSRVTTL}}</td></tr>
 <tr><th align=left>HealthTTL</th><td>Cache lifetime for SRV Target</td><td align=right>{{.HealthTTL}}</td></tr>
+<tr><th align=left>Selector</th><td>Target selection algorithm</td><td>{{if .Selector}}{{.Selector}}{{else}}random{{end}}</td></tr>
+<tr><th align=left>DNSServers</th><td>Built-in resolver servers</td><td>{{.DNSServers}}</td></tr>
 </table>
 {{end}}
 `
@@ -61,6 +77,7 @@ const (
 <h3>CSLB Global Statistics</h3>
 <table border=1>
 <tr><th align=left>Intercepted calls to DialContext</th><td align=right>{{.DialContext}}</td></tr>
+<tr><th align=left>Calls to Dialer.DialService</th><td align=right>{{.DialService}}</td></tr>
 <tr><th align=left>Host or service don't match or interception disabled</th><td align=right>{{.MissHostService}}</td></tr>
 <tr><th align=left>Times SRV lookup returned zero targets</th><td align=right>{{.NoSRV}}</td></tr>
 <tr><th align=left>Calls to bestTarget()</th><td align=right>{{.BestTarget}}</td></tr>
@@ -68,6 +85,13 @@ const (
 <tr><th align=left>system DialContext returned a good connection</th><td align=right>{{.GoodDials}}</td></tr>
 <tr><th align=left>system DialContext returned an error</th><td align=right>{{.FailedDials}}</td></tr>
 <tr><th align=left>Times intercept deadline expired</th><td align=right>{{.Deadline}}</td></tr>
+<tr><th align=left>Late connections closed after deadline expired</th><td align=right>{{.AbandonedConns}}</td></tr>
+<tr><th align=left>Active SRVs re-fetched ahead of expiry</th><td align=right>{{.SRVRefreshes}}</td></tr>
+<tr><th align=left>SRV lookups with a transient DNS failure</th><td align=right>{{.TransientSRV}}</td></tr>
+<tr><th align=left>SRV lookups answered with stale targets</th><td align=right>{{.StaleSRV}}</td></tr>
+<tr><th align=left>SRV lookups which waited on a concurrent lookup</th><td align=right>{{.CoalescedSRV}}</td></tr>
+<tr><th align=left>Health checks run</th><td align=right>{{.HealthChecks}}</td></tr>
+<tr><th align=left>Health checks started more than a second late</th><td align=right>{{.LateChecks}}</td></tr>
 </table>
 {{end}}
 `
@@ -75,15 +99,15 @@ const (
 	srvStr = `{{define "srv"}}
 <h3>SRV DNS Cache</h3>
 <table border=1>
-<tr><th>CName</th><th align=right>Expires</th><th align=right>Lookups</th>
-<th>Priority</th><th>Internal Weight</th><th>Port</th><th>Target</th>
-<th>Good Dials</th><th>Failed Dials</th><th align=center>IsGood</th></tr>
+<tr><th>CName</th><th align=right>Expires</th><th align=right>Lookups</th><th>DNS Status</th>
+<th>Priority</th><th>Signalled<br>Algorithm</th><th>Internal Weight</th><th>Port</th><th>Target</th>
+<th>Good Dials</th><th>Failed Dials</th><th align=center>IsGood</th><th align=center>IsStale</th></tr>
 {{range .Srvs}}
 <tr>
-<td>{{.CName}}</td><td align=right>{{.Expires}}</td></td><td align=right>{{.Lookups}}</td>
-<td align=right>{{.Priority}}</td><td align=right>{{.Weight}}</td>
+<td>{{.CName}}</td><td align=right>{{.Expires}}</td></td><td align=right>{{.Lookups}}</td><td>{{.DNSStatus}}</td>
+<td align=right>{{.Priority}}</td><td>{{.Algorithm}}</td><td align=right>{{.Weight}}</td>
 <td align=right>{{.Port}}</td><td>{{.Target}}</td><td align=right>{{.GoodDials}}</td>
-<td align=right>{{.FailedDials}}</td><td align=center>{{.IsGood}}</td>
+<td align=right>{{.FailedDials}}</td><td align=center>{{.IsGood}}</td><td align=center>{{.IsStale}}</td>
 </tr>
 {{end}}
 </table>
@@ -94,16 +118,22 @@ const (
 <h3>Target Health Cache</h3>
 <table border=1>
 <tr>
-<th>Target</th><th align=right>Expires</th><th>Good Dials</th><th>Failed Dials</th><th>Next Dial<br>Attempt</th>
+<th>Target</th><th align=right>Expires</th><th>Good Dials</th><th>Failed Dials</th><th>Consecutive<br>Failed Dials</th><th>Next Dial<br>Attempt</th>
 <th>Last Dial<br>Attempt</th><th>isGood</th><th>Last Dial<br>Status</th><th>Last Health<br>Check</th>
-<th>Health Check URL</th><th>Last Health<br>Status</th>
+<th>Health Check URL</th><th>Last Health<br>Status</th><th>Weight<br>Bias</th><th>Consecutive<br>HC Failures</th><th>Rise/Fall</th>
+<th>Dials in<br>Progress</th><th>RTT</th><th>Open<br>Conns</th><th>Closed<br>Conns</th>
+<th>Bytes<br>Read</th><th>Bytes<br>Written</th><th>Average Conn<br>Lifetime</th>
 <tr>
 {{range .Targets}}
 <tr>
 <td>{{.Key}}</td>
 <td align=right>{{.Expires}}</td><td align=right>{{.GoodDials}}</td><td align=right>{{.FailedDials}}</td>
-<td align=right>{{.NextDialAttempt}}</td><td align=right>{{.LastDialAttempt}}</td><td align=center>{{.IsGood}}</td>
+<td align=right>{{.DialFailures}}</td><td align=right>{{.NextDialAttempt}}</td><td align=right>{{.LastDialAttempt}}</td><td align=center>{{.IsGood}}</td>
 <td>{{.LastDialStatus}}</td><td align=right>{{.LastHealthCheck}}</td><td>{{.Url}}</td><td>{{.LastHealthCheckStatus}}</td>
+<td align=right>{{.WeightBias}}</td><td align=right>{{.HCFailures}}</td><td align=center>{{.RiseFall}}</td>
+<td align=right>{{.Dialing}}</td><td align=right>{{.RTT}}</td><td align=right>{{.OpenConns}}</td>
+<td align=right>{{.ClosedConns}}</td><td align=right>{{.BytesRead}}</td><td align=right>{{.BytesWritten}}</td>
+<td align=right>{{.ConnLifetime}}</td>
 </tr>
 {{end}}
 </table>
@@ -247,6 +277,7 @@ func (t *statusServer) generateStatus(w http.ResponseWriter, req *http.Request)
 			srvStats.Srvs[ix].CName = ""
 			srvStats.Srvs[ix].Expires = ""
 			srvStats.Srvs[ix].Lookups = ""
+			srvStats.Srvs[ix].DNSStatus = ""
 		} else {
 			prevCName = srvStats.Srvs[ix].CName
 		}